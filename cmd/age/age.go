@@ -8,14 +8,22 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	_log "log"
+	"mime"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 
 	"filippo.io/age/internal/age"
+	"filippo.io/age/internal/format"
+	"filippo.io/age/internal/segment"
+	"filippo.io/age/internal/values"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -29,16 +37,39 @@ func (f *multiFlag) Set(value string) error {
 }
 
 const usage = `Usage:
-    age -r RECIPIENT [-a] [-o OUTPUT] [INPUT]
-    age --decrypt [-i KEY] [-o OUTPUT] [INPUT]
+    age -r RECIPIENT [-a] [-z] [--pad PAD] [--policy FILE] [--metadata] [-o OUTPUT] [INPUT]
+    age -r RECIPIENT --split-size SIZE -o OUTPUT [INPUT]
+    age --decrypt [-i KEY] [-v] [--print-file-key] [-o OUTPUT] [INPUT]
+    age --decrypt [-i KEY] --restore-name [INPUT]
+    age --decrypt [-i KEY] --verify [INPUT]
+    age --decrypt [-i KEY] --recover -o OUTPUT [INPUT]
+    age --decrypt [-i KEY] [-o OUTPUT] SEGMENT...
+    age --decrypt --file-key FILEKEY [-o OUTPUT] [INPUT]
+    age --values [-r RECIPIENT] [-a] [--rules RULES] [-o OUTPUT] INPUT
+    age --decrypt --values [-i KEY] [-o OUTPUT] INPUT
 
 Options:
     -o, --output OUTPUT         Write the result to the file at path OUTPUT.
     -a, --armor                 Encrypt to a PEM encoded format.
     -p, --passphrase            Encrypt with a passphrase.
+    -z, --compress ALG          Compress the input with ALG (zstd, the default, or gzip).
+    --pad PAD                   Pad the input to hide its size, see below.
     -r, --recipient RECIPIENT   Encrypt to the specified RECIPIENT. Can be repeated.
     -d, --decrypt               Decrypt the input to the output.
     -i, --identity KEY          Use the private key file at path KEY. Can be repeated.
+    -v, --verbose               Report which key was used to decrypt the input.
+    --print-file-key            Output the file key of the input instead of decrypting it.
+    --file-key FILEKEY          Decrypt the input with FILEKEY instead of a private key.
+    --policy FILE               Check recipients against the policy at path FILE.
+    --metadata                  Store the name, mode, time and type of INPUT in the file.
+    --split-size SIZE           Split the output into OUTPUT.000, OUTPUT.001, ... of SIZE.
+    --restore-name              Write the output to the file name stored with --metadata.
+    --max-decompressed-size SIZE
+                                Decrypt compressed inputs up to SIZE (like 10G).
+    --verify                    Check that the input is intact, and discard the output.
+    --recover                   Decrypt as much as possible of a damaged input.
+    --values                    Encrypt only the values of the JSON or YAML INPUT.
+    --rules RULES               Pick the --values recipients from the file at path RULES.
 
 INPUT defaults to standard input, and OUTPUT defaults to standard output.
 
@@ -46,8 +77,38 @@ RECIPIENT can be an age public key, as generated by age-keygen, ("age1...")
 or an SSH public key ("ssh-ed25519 AAAA...", "ssh-rsa AAAA...").
 
 KEY is a path to a file with age secret keys, one per line
-(ignoring "#" prefixed comments and empty lines), or to an SSH key file.
-Multiple keys can be provided, and any unused ones will be ignored.
+(ignoring "#" prefixed comments and empty lines), and/or any number of
+PEM encoded SSH or PKCS#8 private keys. Multiple keys can be provided,
+and any unused ones will be ignored.
+
+FILEKEY, as output by --print-file-key, can only decrypt the file it was
+printed for, and can be shared to grant access to it without sharing KEY.
+
+Compressed files are decompressed automatically, up to 100 times the
+size of their input, or SIZE. Compression reveals information about the
+input through the file size: don't use it if the input mixes secrets with
+data that might be chosen by someone who can observe the encrypted file.
+
+--verify and --recover report the position of the first damaged or missing
+part of the input. --recover keeps the data before it, and renames OUTPUT
+to OUTPUT.incomplete if the input is damaged.
+
+SEGMENT is a file written by --split-size. All of them must be provided, in
+any order, like "age -d -o OUTPUT OUTPUT.*". Missing, duplicate or out of
+place segments are detected. Segments are split between 64 KiB chunks of
+the payload, so --split-size must be at least 65592 bytes.
+
+PAD is "padme", to pad the input by up to 12% leaking only the order of
+magnitude of its size, or a SIZE, to pad it to a multiple of SIZE.
+
+FILE is a recipient policy, with one directive per line: "allow TYPE...",
+"min-rsa-bits N", "revoke KEY" (an "age1..." key or "SHA256:..." SSH
+fingerprint), or "escrow RECIPIENT" to always encrypt to RECIPIENT.
+
+With --values, if no recipients are specified, they are picked from the
+first rule in RULES that matches the path of INPUT relative to RULES, with
+one "PATTERN RECIPIENT" rule per line. RULES defaults to the closest
+.age-rules file in the directory of INPUT or in its parents.
 
 Example:
     $ age-keygen -o key.txt
@@ -60,8 +121,16 @@ func main() {
 	flag.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", usage) }
 
 	var (
-		outFlag                          string
+		outFlag, policyFlag, fileKeyFlag string
+		rulesFlag, compressFlag          string
+		splitFlag                        string
+		maxDecompressedFlag, padFlag     string
 		decryptFlag, armorFlag, passFlag bool
+		aesGCMFlag, verboseFlag          bool
+		printFileKeyFlag, valuesFlag     bool
+		metadataFlag, restoreNameFlag    bool
+		verifyFlag, recoverFlag          bool
+		zstdFlag                         bool
 		recipientFlags, identityFlags    multiFlag
 	)
 
@@ -77,11 +146,41 @@ func main() {
 	flag.Var(&recipientFlags, "recipient", "recipient (can be repeated)")
 	flag.Var(&identityFlags, "i", "identity (can be repeated)")
 	flag.Var(&identityFlags, "identity", "identity (can be repeated)")
+	flag.BoolVar(&verboseFlag, "v", false, "report which key was used")
+	flag.BoolVar(&verboseFlag, "verbose", false, "report which key was used")
+	flag.BoolVar(&printFileKeyFlag, "print-file-key", false, "output the file key")
+	flag.StringVar(&fileKeyFlag, "file-key", "", "decrypt with the file key `FILEKEY`")
+	flag.StringVar(&policyFlag, "policy", "", "recipient policy `FILE`")
+	flag.BoolVar(&zstdFlag, "z", false, "compress the input with zstd")
+	flag.StringVar(&compressFlag, "compress", "", "compress the input with `ALG`")
+	flag.StringVar(&padFlag, "pad", "", "pad the input with the `PAD` scheme")
+	flag.StringVar(&maxDecompressedFlag, "max-decompressed-size", "", "maximum decompressed `SIZE`")
+	flag.BoolVar(&metadataFlag, "metadata", false, "store the metadata of the input file")
+	flag.StringVar(&splitFlag, "split-size", "", "split the output into segments of `SIZE`")
+	flag.BoolVar(&restoreNameFlag, "restore-name", false, "output to the stored file name")
+	flag.BoolVar(&verifyFlag, "verify", false, "check the input without decrypting it")
+	flag.BoolVar(&recoverFlag, "recover", false, "decrypt as much as possible of a damaged input")
+	flag.BoolVar(&valuesFlag, "values", false, "encrypt only the values of a JSON or YAML document")
+	flag.StringVar(&rulesFlag, "rules", "", "creation rules `FILE` for --values")
+	// Intentionally not in the usage, as files produced with it are not
+	// age-encryption.org/v1 compatible.
+	flag.BoolVar(&aesGCMFlag, "experimental-aes-gcm", false, "use the experimental AES-256-GCM payload format")
 	flag.Parse()
 
-	if flag.NArg() > 1 {
+	if flag.NArg() > 1 && (!decryptFlag || valuesFlag) {
 		logFatalf("Error: too many arguments.\n" +
-			"age accepts a single optional argument for the input file.")
+			"age accepts a single optional argument for the input file, or\n" +
+			"the segments of a file split with --split-size when decrypting.")
+	}
+	if valuesFlag && (flag.Arg(0) == "" || flag.Arg(0) == "-") {
+		logFatalf("Error: --values requires an INPUT file.\n" +
+			"The document format is detected from its extension.")
+	}
+	if valuesFlag && aesGCMFlag {
+		logFatalf("Error: --experimental-aes-gcm can't be combined with --values.")
+	}
+	if rulesFlag != "" && (!valuesFlag || decryptFlag) {
+		logFatalf("Error: --rules can only be used with --values in encryption mode.")
 	}
 	switch {
 	case decryptFlag:
@@ -97,22 +196,134 @@ func main() {
 			logFatalf("Error: -r/--recipient can't be used with -d/--decrypt.\n" +
 				"Did you mean to use -i/--identity to specify a private key?")
 		}
+		if policyFlag != "" {
+			logFatalf("Error: --policy can't be used with -d/--decrypt.")
+		}
+		if aesGCMFlag {
+			logFatalf("Error: --experimental-aes-gcm can't be used with -d/--decrypt.\n" +
+				"Note that the payload format is detected automatically.")
+		}
+		if fileKeyFlag != "" && len(identityFlags) > 0 {
+			logFatalf("Error: --file-key can't be combined with -i/--identity.")
+		}
+		if fileKeyFlag != "" && printFileKeyFlag {
+			logFatalf("Error: --file-key can't be combined with --print-file-key.")
+		}
+		if fileKeyFlag != "" && verboseFlag {
+			logFatalf("Error: --file-key can't be combined with -v/--verbose.")
+		}
+		if valuesFlag && (fileKeyFlag != "" || printFileKeyFlag || verboseFlag || maxDecompressedFlag != "") {
+			logFatalf("Error: --values can't be combined with --file-key, --print-file-key, -v/--verbose or --max-decompressed-size.")
+		}
+		if padFlag != "" {
+			logFatalf("Error: --pad can't be used with -d/--decrypt.\n" +
+				"Note that padding is removed automatically.")
+		}
+		if zstdFlag || compressFlag != "" {
+			logFatalf("Error: -z/--compress can't be used with -d/--decrypt.\n" +
+				"Note that compressed files are detected automatically.")
+		}
+		if metadataFlag {
+			logFatalf("Error: --metadata can't be used with -d/--decrypt.\n" +
+				"Did you mean to use --restore-name?")
+		}
+		if splitFlag != "" {
+			logFatalf("Error: --split-size can't be used with -d/--decrypt.\n" +
+				"Pass all the segments as inputs to join them.")
+		}
+		if restoreNameFlag && (outFlag != "" || valuesFlag || fileKeyFlag != "" || printFileKeyFlag) {
+			logFatalf("Error: --restore-name can't be combined with -o/--output, --values, --file-key or --print-file-key.")
+		}
+		if verifyFlag && recoverFlag {
+			logFatalf("Error: --verify can't be combined with --recover.")
+		}
+		if (verifyFlag || recoverFlag) && (valuesFlag || fileKeyFlag != "" || printFileKeyFlag || restoreNameFlag) {
+			logFatalf("Error: --verify and --recover can't be combined with --values, --file-key, --print-file-key or --restore-name.")
+		}
+		if verifyFlag && outFlag != "" {
+			logFatalf("Error: --verify can't be combined with -o/--output.\n" +
+				"The decrypted data is discarded.")
+		}
+		if recoverFlag && (outFlag == "" || outFlag == "-") {
+			logFatalf("Error: --recover requires -o/--output.\n" +
+				"The output file is renamed if the input is damaged, to mark it as incomplete.")
+		}
 	default: // encrypt
 		if len(identityFlags) > 0 {
 			logFatalf("Error: -i/--identity can't be used in encryption mode.\n" +
 				"Did you forget to specify -d/--decrypt?")
 		}
-		if len(recipientFlags) == 0 && !passFlag {
+		if verboseFlag {
+			logFatalf("Error: -v/--verbose can only be used with -d/--decrypt.")
+		}
+		if printFileKeyFlag || fileKeyFlag != "" {
+			logFatalf("Error: --print-file-key and --file-key can only be used with -d/--decrypt.")
+		}
+		if restoreNameFlag {
+			logFatalf("Error: --restore-name can only be used with -d/--decrypt.")
+		}
+		if verifyFlag || recoverFlag {
+			logFatalf("Error: --verify and --recover can only be used with -d/--decrypt.")
+		}
+		if maxDecompressedFlag != "" {
+			logFatalf("Error: --max-decompressed-size can only be used with -d/--decrypt.")
+		}
+		if zstdFlag && compressFlag != "" && compressFlag != "zstd" {
+			logFatalf("Error: -z can't be combined with --compress %s.", compressFlag)
+		}
+		if compressFlag != "" && compressFlag != "zstd" && compressFlag != "gzip" {
+			logFatalf("Error: unknown compression algorithm %q.\n"+
+				"Supported algorithms are zstd and gzip.", compressFlag)
+		}
+		if (zstdFlag || compressFlag != "" || padFlag != "") && valuesFlag {
+			logFatalf("Error: -z/--compress and --pad can't be combined with --values.")
+		}
+		if metadataFlag && (flag.Arg(0) == "" || flag.Arg(0) == "-") {
+			logFatalf("Error: --metadata requires an INPUT file.")
+		}
+		if metadataFlag && valuesFlag {
+			logFatalf("Error: --metadata can't be combined with --values.")
+		}
+		if splitFlag != "" && (outFlag == "" || outFlag == "-") {
+			logFatalf("Error: --split-size requires -o/--output.\n" +
+				"The segments are named after OUTPUT.")
+		}
+		if splitFlag != "" && (armorFlag || valuesFlag) {
+			logFatalf("Error: --split-size can't be combined with -a/--armor or --values.")
+		}
+		if len(recipientFlags) == 0 && !passFlag && !valuesFlag {
 			logFatalf("Error: missing recipients.\n" +
 				"Did you forget to specify -r/--recipient or -p/--passphrase?")
 		}
 		if len(recipientFlags) > 0 && passFlag {
 			logFatalf("Error: -p/--passphrase can't be combined with -r/--recipient.")
 		}
+		if passFlag && !valuesFlag && (zstdFlag || compressFlag != "" || padFlag != "" || metadataFlag) {
+			logFatalf("Error: -p/--passphrase can't be combined with -z/--compress, --pad or --metadata.")
+		}
+	}
+
+	var policy *age.Policy
+	if policyFlag != "" {
+		p, err := parsePolicyFile(policyFlag)
+		if err != nil {
+			logFatalf("Error: %v", err)
+		}
+		policy = p
 	}
 
-	var in, out io.ReadWriter = os.Stdin, os.Stdout
-	if name := flag.Arg(0); name != "" && name != "-" {
+	var in io.Reader = os.Stdin
+	var out io.Writer = os.Stdout
+	var split *segment.Writer
+	if name := flag.Arg(0); decryptFlag && !valuesFlag &&
+		(flag.NArg() > 1 || name != "-" && segment.IsSegment(name)) {
+		r, err := segment.Join(flag.Args()...)
+		if err != nil {
+			logFatalf("Error: failed to open input segments: %v", err)
+		}
+		defer r.Close()
+		in, joined = r, r
+	} else if name != "" && name != "-" {
 		f, err := os.Open(name)
 		if err != nil {
 			logFatalf("Error: failed to open input file %q: %v", name, err)
@@ -120,16 +331,26 @@ func main() {
 		defer f.Close()
 		in = f
 	} else {
-		stdinInUse = true
+		prompter.StdinInUse = true
 	}
-	if name := outFlag; name != "" && name != "-" {
+	if name := outFlag; splitFlag != "" {
+		size, err := parseSize(splitFlag)
+		if err != nil {
+			logFatalf("Error: invalid --split-size: %v", err)
+		}
+		split, err = segment.NewWriter(name, size)
+		if err != nil {
+			logFatalf("Error: invalid --split-size: %v", err)
+		}
+		out = split
+	} else if name != "" && name != "-" {
 		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 		if err != nil {
 			logFatalf("Error: failed to open output file %q: %v", name, err)
 		}
 		defer f.Close()
 		out = f
-	} else if terminal.IsTerminal(int(os.Stdout.Fd())) && !decryptFlag {
+	} else if terminal.IsTerminal(int(os.Stdout.Fd())) && !decryptFlag && !valuesFlag {
 		if armorFlag {
 			// If the output will go to a TTY, and it will be armored, buffer it
 			// up so it doesn't get in the way of typing the input.
@@ -144,23 +365,104 @@ func main() {
 		}
 	}
 
+	opts := &age.EncryptOptions{
+		Armor:              armorFlag,
+		ExperimentalAESGCM: aesGCMFlag,
+	}
+	if zstdFlag {
+		opts.Compress = "zstd"
+	}
+	if compressFlag != "" {
+		opts.Compress = compressFlag
+	}
+	if padFlag == "padme" {
+		opts.Pad = age.Padme
+	} else if padFlag != "" {
+		size, err := parseSize(padFlag)
+		if err != nil {
+			logFatalf("Error: invalid --pad: %v\n"+
+				`Use "padme" or a size like 1M.`, err)
+		}
+		opts.Pad = age.PadToMultiple(size)
+	}
+	if metadataFlag {
+		m, err := inputMetadata(flag.Arg(0))
+		if err != nil {
+			logFatalf("Error: %v", err)
+		}
+		opts.Metadata = m
+	}
 	switch {
+	case valuesFlag && decryptFlag:
+		decryptValues(identityFlags, flag.Arg(0), in, out)
+	case valuesFlag:
+		var recipients []age.Recipient
+		switch {
+		case passFlag:
+			pass, err := passphrasePromptForEncryption()
+			if err != nil {
+				logFatalf("Error: %v", err)
+			}
+			r, err := age.NewScryptRecipient(pass)
+			if err != nil {
+				logFatalf("Error: %v", err)
+			}
+			recipients = append(recipients, r)
+		case len(recipientFlags) > 0:
+			recipients = parseRecipientFlags(recipientFlags)
+		default:
+			rs, err := recipientsFromRules(rulesFlag, flag.Arg(0))
+			if err != nil {
+				logFatalf("Error: %v", err)
+			}
+			recipients = rs
+		}
+		encryptValues(recipients, flag.Arg(0), in, out, armorFlag, policy)
 	case decryptFlag:
-		decrypt(identityFlags, in, out)
+		decryptOpts := &age.DecryptOptions{Prompter: prompter}
+		if maxDecompressedFlag != "" {
+			size, err := parseSize(maxDecompressedFlag)
+			if err != nil {
+				logFatalf("Error: invalid --max-decompressed-size: %v", err)
+			}
+			decryptOpts.MaxDecompressedSize = size
+		}
+		if fileKeyFlag != "" {
+			decryptWithFileKey(fileKeyFlag, in, out, decryptOpts)
+		} else {
+			var recoverTo string
+			if recoverFlag {
+				recoverTo = outFlag
+			}
+			decrypt(identityFlags, in, out, decryptOpts, verboseFlag, printFileKeyFlag, restoreNameFlag, verifyFlag, recoverTo)
+		}
 	case passFlag:
 		pass, err := passphrasePromptForEncryption()
 		if err != nil {
 			logFatalf("Error: %v", err)
 		}
-		encryptPass(pass, in, out, armorFlag)
+		encryptPass(pass, in, out, opts, policy)
 	default:
-		encryptKeys(recipientFlags, in, out, armorFlag)
+		encryptKeys(recipientFlags, in, out, opts, policy)
+	}
+
+	if split != nil {
+		if err := split.Close(); err != nil {
+			logFatalf("Error: failed to write the last segment: %v", err)
+		}
 	}
 }
 
+// prompter is used for all interactions with the user. It's a singleton like
+// os.Stdin, and StdinInUse is set in main.
+var prompter = &age.TerminalPrompter{}
+
+// joined is the input, if it was joined from segments. It's set in main, and
+// used to report which segment is damaged or out of place.
+var joined *segment.Reader
+
 func passphrasePromptForEncryption() (string, error) {
-	fmt.Fprintf(os.Stderr, "Enter passphrase (leave empty to autogenerate a secure one): ")
-	pass, err := readPassphrase()
+	pass, err := prompter.RequestSecret("Enter passphrase (leave empty to autogenerate a secure one)")
 	if err != nil {
 		return "", fmt.Errorf("could not read passphrase: %v", err)
 	}
@@ -171,10 +473,9 @@ func passphrasePromptForEncryption() (string, error) {
 			words = append(words, randomWord())
 		}
 		p = strings.Join(words, "-")
-		fmt.Fprintf(os.Stderr, "Using the autogenerated passphrase %q.\n", p)
+		prompter.Display(fmt.Sprintf("Using the autogenerated passphrase %q.", p))
 	} else {
-		fmt.Fprintf(os.Stderr, "Confirm passphrase: ")
-		confirm, err := readPassphrase()
+		confirm, err := prompter.RequestSecret("Confirm passphrase")
 		if err != nil {
 			return "", fmt.Errorf("could not read passphrase: %v", err)
 		}
@@ -185,32 +486,40 @@ func passphrasePromptForEncryption() (string, error) {
 	return p, nil
 }
 
-func encryptKeys(keys []string, in io.Reader, out io.Writer, armor bool) {
+func parseRecipientFlags(keys []string) []age.Recipient {
 	var recipients []age.Recipient
 	for _, arg := range keys {
-		r, err := parseRecipient(arg)
+		r, err := age.ParseRecipient(arg)
 		if err != nil {
 			logFatalf("Error: %v", err)
 		}
 		recipients = append(recipients, r)
 	}
-	encrypt(recipients, in, out, armor)
+	return recipients
 }
 
-func encryptPass(pass string, in io.Reader, out io.Writer, armor bool) {
+func encryptKeys(keys []string, in io.Reader, out io.Writer, opts *age.EncryptOptions, policy *age.Policy) {
+	encrypt(parseRecipientFlags(keys), in, out, opts, policy)
+}
+
+func encryptPass(pass string, in io.Reader, out io.Writer, opts *age.EncryptOptions, policy *age.Policy) {
 	r, err := age.NewScryptRecipient(pass)
 	if err != nil {
 		logFatalf("Error: %v", err)
 	}
-	encrypt([]age.Recipient{r}, in, out, armor)
+	encrypt([]age.Recipient{r}, in, out, opts, policy)
 }
 
-func encrypt(recipients []age.Recipient, in io.Reader, out io.Writer, armor bool) {
-	ageEncrypt := age.Encrypt
-	if armor {
-		ageEncrypt = age.EncryptWithArmor
+func encrypt(recipients []age.Recipient, in io.Reader, out io.Writer, opts *age.EncryptOptions, policy *age.Policy) {
+	if policy != nil {
+		rs, err := policy.Apply(recipients)
+		if err != nil {
+			logFatalf("Error: %v", err)
+		}
+		recipients = rs
 	}
-	w, err := ageEncrypt(out, recipients...)
+
+	w, err := age.EncryptWithOptions(out, opts, recipients...)
 	if err != nil {
 		logFatalf("Error: %v", err)
 	}
@@ -222,12 +531,122 @@ func encrypt(recipients []age.Recipient, in io.Reader, out io.Writer, armor bool
 	}
 }
 
-func decrypt(keys []string, in io.Reader, out io.Writer) {
+func encryptValues(recipients []age.Recipient, name string, in io.Reader, out io.Writer, armor bool, policy *age.Policy) {
+	if policy != nil {
+		rs, err := policy.Apply(recipients)
+		if err != nil {
+			logFatalf("Error: %v", err)
+		}
+		recipients = rs
+	}
+	f, err := values.FormatForPath(name)
+	if err != nil {
+		logFatalf("Error: %v", err)
+	}
+	doc, err := ioutil.ReadAll(in)
+	if err != nil {
+		logFatalf("Error: failed to read input file %q: %v", name, err)
+	}
+	enc, err := values.Encrypt(doc, f, &values.EncryptOptions{Armor: armor}, recipients...)
+	if err != nil {
+		logFatalf("Error: %v", err)
+	}
+	if _, err := out.Write(enc); err != nil {
+		logFatalf("Error: %v", err)
+	}
+}
+
+// recipientsFromRules returns the recipients of the first rule matching the
+// input file name, from rulesFile or from the closest .age-rules file.
+func recipientsFromRules(rulesFile, name string) ([]age.Recipient, error) {
+	if rulesFile == "" {
+		f, err := findRulesFile(filepath.Dir(name))
+		if err != nil {
+			return nil, err
+		}
+		rulesFile = f
+	}
+	rules, err := parseRulesFile(rulesFile)
+	if err != nil {
+		return nil, err
+	}
+	absRules, err := filepath.Abs(filepath.Dir(rulesFile))
+	if err != nil {
+		return nil, err
+	}
+	absName, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(absRules, absName)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := values.MatchRules(rules, filepath.ToSlash(rel))
+	if err != nil {
+		return nil, fmt.Errorf("%v in %q", err, rulesFile)
+	}
+	return rs, nil
+}
+
+func findRulesFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		name := filepath.Join(dir, rulesFileName)
+		if _, err := os.Stat(name); err == nil {
+			return name, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("missing recipients: no %s file found.\n"+
+				"Did you forget to specify -r/--recipient or --rules?", rulesFileName)
+		}
+		dir = parent
+	}
+}
+
+func decryptValues(keys []string, name string, in io.Reader, out io.Writer) {
+	var identities []age.Identity
+	for _, name := range keys {
+		ids, err := parseIdentitiesFile(name)
+		if err != nil {
+			logFatalf("Error: %v", err)
+		}
+		identities = append(identities, ids...)
+	}
+	// The data key might be encrypted with a passphrase.
+	identities = append(identities, &age.LazyScryptIdentity{})
+
+	f, err := values.FormatForPath(name)
+	if err != nil {
+		logFatalf("Error: %v", err)
+	}
+	doc, err := ioutil.ReadAll(in)
+	if err != nil {
+		logFatalf("Error: failed to read input file %q: %v", name, err)
+	}
+	dec, err := values.Decrypt(doc, f, &age.DecryptOptions{Prompter: prompter}, identities...)
+	if err != nil {
+		logFatalf("Error: %v", err)
+	}
+	if _, err := out.Write(dec); err != nil {
+		logFatalf("Error: %v", err)
+	}
+}
+
+// decrypt decrypts in to out. If recoverTo is not empty, it's the name of the
+// file out, which is renamed if in is damaged.
+func decrypt(keys []string, in io.Reader, out io.Writer, opts *age.DecryptOptions, verbose, printFileKey, restoreName, verify bool, recoverTo string) {
 	identities := []age.Identity{
 		// If there is an scrypt recipient (it will have to be the only one and)
 		// this identity will be invoked.
-		&LazyScryptIdentity{passphrasePrompt},
+		&age.LazyScryptIdentity{},
 	}
+	// sources[i] describes where identities[i] came from, for --verbose.
+	sources := []string{"the passphrase"}
 
 	// TODO: use the default location if no arguments are provided:
 	// os.UserConfigDir()/age/keys.txt, ~/.ssh/id_rsa, ~/.ssh/id_ed25519
@@ -237,24 +656,203 @@ func decrypt(keys []string, in io.Reader, out io.Writer) {
 			logFatalf("Error: %v", err)
 		}
 		identities = append(identities, ids...)
+		for _, i := range ids {
+			sources = append(sources, fmt.Sprintf("the %s key from %q", i.Type(), name))
+		}
 	}
 
-	r, err := age.Decrypt(in, identities...)
+	h, err := age.ParseHeader(in)
 	if err != nil {
 		logFatalf("Error: %v", err)
 	}
-	if _, err := io.Copy(out, r); err != nil {
+	fileKey, res, err := h.UnwrapWithOptions(opts, identities...)
+	if err != nil {
 		logFatalf("Error: %v", err)
 	}
+	if verbose {
+		reportDecryptResult(res, identities, sources)
+	}
+	if printFileKey {
+		if _, err := fmt.Fprintf(out, "%s\n", format.EncodeToString(fileKey)); err != nil {
+			logFatalf("Error: %v", err)
+		}
+		return
+	}
+	r, err := h.Open(fileKey)
+	if err != nil {
+		logFatalf("Error: %v", err)
+	}
+	if restoreName {
+		restoreFile(h, r)
+		return
+	}
+	switch {
+	case verify:
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			logDecryptError(h, err)
+		}
+		chunk, _ := h.Position()
+		_log.Printf("OK: the header and all %d chunks of the payload are intact.", chunk)
+	case recoverTo != "":
+		n, err := io.Copy(out, r)
+		if err == nil {
+			return
+		}
+		if c, ok := out.(io.Closer); ok {
+			c.Close()
+		}
+		name := recoverTo + ".incomplete"
+		if err := os.Rename(recoverTo, name); err != nil {
+			logFatalf("Error: failed to mark the output as incomplete: %v", err)
+		}
+		_log.Printf("Warning: recovered only the first %d bytes of the input to %q.", n, name)
+		logDecryptError(h, err)
+	default:
+		if _, err := io.Copy(out, r); err != nil {
+			logDecryptError(h, err)
+		}
+	}
+}
+
+// logDecryptError reports an error reading the payload of h, and where the
+// input is damaged if that's the cause.
+func logDecryptError(h *age.Header, err error) {
+	chunk, offset := h.Position()
+	var authErr *age.ErrChunkAuthentication
+	if joined != nil {
+		logSegmentError(err, chunk, offset)
+	}
+	switch {
+	case errors.Is(err, age.ErrDecompressionLimit):
+		logFatalf("Error: %v\n"+
+			"If the input is legitimate, raise the limit with --max-decompressed-size.", err)
+	case errors.Is(err, age.ErrTruncated):
+		logFatalf("Error: the input is truncated: chunk #%d, at byte offset %d, is missing.\n"+
+			"Everything before it was authenticated.", chunk, offset)
+	case errors.Is(err, age.ErrTrailingData):
+		logFatalf("Error: the input continues after its last chunk, #%d at byte offset %d.\n"+
+			"Was it concatenated with other data?", chunk, offset)
+	case errors.As(err, &authErr):
+		logFatalf("Error: chunk #%d, at byte offset %d, failed to authenticate.\n"+
+			"The input is damaged, or truncated within that chunk. Everything before it was authenticated.",
+			authErr.Index, offset)
+	}
+	logFatalf("Error: %v", err)
+}
+
+// logSegmentError reports a damaged or missing chunk of a joined input in
+// terms of its segments, if possible. The segments are split at chunk
+// boundaries, and each chunk is authenticated along with its position, so a
+// segment that is out of place fails at its first chunk.
+func logSegmentError(err error, chunk, offset int64) {
+	index, name, start := joined.Locate(offset)
+	var authErr *age.ErrChunkAuthentication
+	switch {
+	case errors.Is(err, age.ErrTruncated):
+		logFatalf("Error: the input is truncated: segments after #%d, %q, are missing.\n"+
+			"Everything before them was authenticated.", index, name)
+	case errors.As(err, &authErr) && start:
+		logFatalf("Error: segment #%d, %q, is out of place: its first chunk, #%d, failed to authenticate.\n"+
+			"Was it relabelled, or swapped with another segment? Everything before it was authenticated.", index, name, chunk)
+	case errors.As(err, &authErr):
+		logFatalf("Error: chunk #%d, in segment #%d, %q, failed to authenticate.\n"+
+			"The segment is damaged. Everything before it was authenticated.", chunk, index, name)
+	}
 }
 
-func passphrasePrompt() (string, error) {
-	fmt.Fprintf(os.Stderr, "Enter passphrase: ")
-	pass, err := readPassphrase()
+func inputMetadata(name string) (*age.Metadata, error) {
+	info, err := os.Stat(name)
 	if err != nil {
-		return "", fmt.Errorf("could not read passphrase: %v", err)
+		return nil, fmt.Errorf("failed to stat input file: %v", err)
+	}
+	return &age.Metadata{
+		Name:        filepath.Base(name),
+		Mode:        info.Mode().Perm(),
+		ModTime:     info.ModTime(),
+		ContentType: mime.TypeByExtension(filepath.Ext(name)),
+	}, nil
+}
+
+// restoreFile writes r, opened from h, to a new file in the current directory,
+// named after the metadata record, and restores its mode and modification time.
+func restoreFile(h *age.Header, r io.Reader) {
+	m := h.Metadata()
+	if m == nil || m.Name == "" {
+		logFatalf("Error: the input doesn't store its original file name.\n" +
+			"Was it encrypted with --metadata?")
+	}
+	if !safeFileName(m.Name) {
+		logFatalf("Error: refusing to restore unsafe file name %q.", m.Name)
+	}
+	perm := os.FileMode(0666)
+	if m.Mode != 0 {
+		perm = m.Mode.Perm()
+	}
+	f, err := os.OpenFile(m.Name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		logFatalf("Error: failed to open output file %q: %v", m.Name, err)
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(m.Name)
+		logDecryptError(h, err)
+	}
+	if !m.ModTime.IsZero() {
+		if err := os.Chtimes(m.Name, m.ModTime, m.ModTime); err != nil {
+			logFatalf("Error: %v", err)
+		}
+	}
+}
+
+// safeFileName reports whether name refers to a file in the current
+// directory, and not to a path elsewhere.
+func safeFileName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	if strings.ContainsAny(name, "/\\\x00") {
+		return false
+	}
+	if runtime.GOOS == "windows" && strings.ContainsRune(name, ':') {
+		return false
+	}
+	return filepath.Base(name) == name && !filepath.IsAbs(name)
+}
+
+func decryptWithFileKey(key string, in io.Reader, out io.Writer, opts *age.DecryptOptions) {
+	fileKey, err := format.DecodeString(key)
+	if err != nil || len(fileKey) != 16 {
+		logFatalf("Error: malformed file key %q.", key)
+	}
+	h, err := age.ParseHeader(in)
+	if err != nil {
+		logFatalf("Error: %v", err)
+	}
+	r, err := h.OpenWithOptions(fileKey, opts)
+	if err != nil {
+		logFatalf("Error: %v", err)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		logDecryptError(h, err)
+	}
+}
+
+func reportDecryptResult(res *age.DecryptResult, identities []age.Identity, sources []string) {
+	source := "a " + res.Identity.Type() + " key"
+	for n, i := range identities {
+		if i == res.Identity {
+			source = sources[n]
+		}
+	}
+	stanza := fmt.Sprintf("recipient stanza #%d (%s)", res.StanzaIndex, res.StanzaType)
+	if res.StanzaIndex < 0 {
+		stanza = fmt.Sprintf("a %s recipient stanza", res.StanzaType)
 	}
-	return string(pass), nil
+	_log.Printf("Decrypted using %s, which matched %s out of %d.",
+		source, stanza, len(res.Header.Recipients))
 }
 
 func logFatalf(format string, v ...interface{}) {
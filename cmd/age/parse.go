@@ -9,27 +9,20 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 
 	"filippo.io/age/internal/age"
+	"filippo.io/age/internal/values"
 	"golang.org/x/crypto/ssh"
 )
 
-func parseRecipient(arg string) (age.Recipient, error) {
-	switch {
-	case strings.HasPrefix(arg, "age1"):
-		return age.ParseX25519Recipient(arg)
-	case strings.HasPrefix(arg, "ssh-"):
-		return age.ParseSSHRecipient(arg)
-	}
-
-	return nil, fmt.Errorf("unknown recipient type: %q", arg)
-}
-
 const privateKeySizeLimit = 1 << 24 // 16 MiB
 
 func parseIdentitiesFile(name string) ([]age.Identity, error) {
@@ -47,69 +40,67 @@ func parseIdentitiesFile(name string) ([]age.Identity, error) {
 		return nil, fmt.Errorf("failed to read %q: file too long", name)
 	}
 
-	var ids []age.Identity
-	var ageParsingError error
-	scanner := bufio.NewScanner(bytes.NewReader(contents))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#") || line == "" {
-			continue
-		}
-		if strings.HasPrefix(line, "-----BEGIN") {
-			return parseSSHIdentity(name, contents)
-		}
-		if ageParsingError != nil {
-			continue
-		}
-		i, err := age.ParseX25519Identity(line)
+	ids, err := age.ParseIdentities(bytes.NewReader(contents))
+	var sshErr *ssh.PassphraseMissingError
+	if errors.As(err, &sshErr) && sshErr.PublicKey == nil {
+		ids, err = parseLegacyEncryptedSSHIdentity(name, contents, err)
 		if err != nil {
-			ageParsingError = fmt.Errorf("malformed secret keys file %q: %v", name, err)
-			continue
+			return nil, err
 		}
-		ids = append(ids, i)
-	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to read %q: %v", name, err)
-	}
-	if ageParsingError != nil {
-		return nil, ageParsingError
+	} else if err != nil {
+		return nil, fmt.Errorf("malformed secret keys file %q: %v", name, err)
 	}
-
 	if len(ids) == 0 {
 		return nil, fmt.Errorf("no secret keys found in %q", name)
 	}
-	return ids, nil
-}
 
-func parseSSHIdentity(name string, pemBytes []byte) ([]age.Identity, error) {
-	id, err := age.ParseSSHIdentity(pemBytes)
-	if sshErr, ok := err.(*ssh.PassphraseMissingError); ok {
-		pubKey := sshErr.PublicKey
-		if pubKey == nil {
-			pubKey, err = readPubFile(name)
-			if err != nil {
-				return nil, err
-			}
+	var encrypted []*age.EncryptedSSHIdentity
+	for _, i := range ids {
+		if i, ok := i.(*age.EncryptedSSHIdentity); ok {
+			encrypted = append(encrypted, i)
 		}
-		passphrasePrompt := func() ([]byte, error) {
-			fmt.Fprintf(os.Stderr, "Enter passphrase for %q: ", name)
-			pass, err := readPassphrase()
-			if err != nil {
-				return nil, fmt.Errorf("could not read passphrase for %q: %v", name, err)
-			}
-			return pass, nil
+	}
+	for _, i := range encrypted {
+		if len(encrypted) > 1 {
+			i.SetName(fmt.Sprintf("%q (%s)", name, ssh.FingerprintSHA256(i.PublicKey())))
+		} else {
+			i.SetName(fmt.Sprintf("%q", name))
 		}
-		i, err := NewEncryptedSSHIdentity(pubKey, pemBytes, passphrasePrompt)
-		if err != nil {
-			return nil, err
+	}
+
+	return ids, nil
+}
+
+// parseLegacyEncryptedSSHIdentity handles encrypted PEM keys in the legacy
+// format, which doesn't embed the public key. If the file is just that key,
+// there might be a ".pub" file next to it.
+func parseLegacyEncryptedSSHIdentity(name string, contents []byte, err error) ([]age.Identity, error) {
+	if !isLoneKey(contents) {
+		line := 0
+		var parseErr *age.ParseError
+		if errors.As(err, &parseErr) {
+			line = parseErr.Line
 		}
-		return []age.Identity{i}, nil
+		return nil, fmt.Errorf(`failed to obtain public key for SSH key at line %d of %q
+
+    Convert the private key to a modern format with "ssh-keygen -p -m RFC4716", or move it to its own file next to a ".pub" file`, line, name)
+	}
+	pubKey, err := readPubFile(name)
+	if err != nil {
+		return nil, err
 	}
+	i, err := age.NewEncryptedSSHIdentity(pubKey, contents)
 	if err != nil {
-		return nil, fmt.Errorf("malformed SSH identity in %q: %v", name, err)
+		return nil, err
 	}
+	return []age.Identity{i}, nil
+}
 
-	return []age.Identity{id}, nil
+// isLoneKey returns whether contents is a single PEM block.
+func isLoneKey(contents []byte) bool {
+	contents = bytes.TrimSpace(contents)
+	return bytes.HasPrefix(contents, []byte("-----BEGIN")) &&
+		bytes.Count(contents, []byte("-----BEGIN")) == 1
 }
 
 func readPubFile(name string) (ssh.PublicKey, error) {
@@ -130,3 +121,129 @@ func readPubFile(name string) (ssh.PublicKey, error) {
 	}
 	return pubKey, nil
 }
+
+// parsePolicyFile reads a recipient policy file. Each non-empty line that
+// doesn't start with "#" is a directive:
+//
+//	allow TYPE...          allow only recipients of the listed types
+//	min-rsa-bits N         reject ssh-rsa recipients smaller than N bits
+//	revoke KEY             reject an "age1..." or "SHA256:..." SSH key
+//	escrow RECIPIENT       always encrypt to RECIPIENT as well
+func parsePolicyFile(name string) (*age.Policy, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policy file: %v", err)
+	}
+	defer f.Close()
+
+	p := &age.Policy{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		directive, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			directive, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		if arg == "" {
+			return nil, fmt.Errorf("malformed policy file %q at line %d: missing argument", name, n)
+		}
+		switch directive {
+		case "allow":
+			p.AllowedTypes = append(p.AllowedTypes, strings.Fields(arg)...)
+		case "min-rsa-bits":
+			bits, err := strconv.Atoi(arg)
+			if err != nil || bits <= 0 {
+				return nil, fmt.Errorf("malformed policy file %q at line %d: invalid RSA size %q", name, n, arg)
+			}
+			p.MinRSABits = bits
+		case "revoke":
+			p.Revoked = append(p.Revoked, arg)
+		case "escrow":
+			r, err := age.ParseRecipient(arg)
+			if err != nil {
+				return nil, fmt.Errorf("malformed policy file %q at line %d: %v", name, n, err)
+			}
+			p.Escrow = append(p.Escrow, r)
+		default:
+			return nil, fmt.Errorf("malformed policy file %q at line %d: unknown directive %q", name, n, directive)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", name, err)
+	}
+	return p, nil
+}
+
+// rulesFileName is the name of the creation rules file looked up by --values.
+const rulesFileName = ".age-rules"
+
+// parseRulesFile parses a creation rules file, with one "PATTERN RECIPIENT"
+// rule per line. Consecutive lines with the same PATTERN add recipients to
+// the same rule.
+func parseRulesFile(name string) ([]values.Rule, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rules file: %v", err)
+	}
+	defer f.Close()
+
+	var rules []values.Rule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed rules file %q at line %d: missing recipient", name, n)
+		}
+		pattern, arg := line[:i], strings.TrimSpace(line[i+1:])
+		r, err := age.ParseRecipient(arg)
+		if err != nil {
+			return nil, fmt.Errorf("malformed rules file %q at line %d: %v", name, n, err)
+		}
+		if len(rules) == 0 || rules[len(rules)-1].Pattern != pattern {
+			rules = append(rules, values.Rule{Pattern: pattern})
+		}
+		rules[len(rules)-1].Recipients = append(rules[len(rules)-1].Recipients, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", name, err)
+	}
+	return rules, nil
+}
+
+// parseSize parses a size in bytes, optionally followed by a K, M, G or T
+// suffix for the respective power of 1024.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	shift := 0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	case "T":
+		shift = 40
+	}
+	num := s
+	if shift != 0 {
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("malformed size %q", s)
+	}
+	if n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n << shift, nil
+}
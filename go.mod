@@ -1,5 +1,9 @@
 module filippo.io/age
 
-go 1.13
+go 1.16
 
-require golang.org/x/crypto v0.0.0-20200219234226-1ad67e1f0ef4
+require (
+	github.com/klauspost/compress v1.15.9
+	golang.org/x/crypto v0.0.0-20200219234226-1ad67e1f0ef4
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -8,7 +8,7 @@
 package age
 
 import (
-	"crypto/hmac"
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
@@ -28,6 +28,19 @@ type IdentityMatcher interface {
 	Matches(block *format.Recipient) error
 }
 
+// StanzasIdentity can be optionally implemented by an Identity that needs to
+// see all the recipient stanzas of a file at once, such as a hardware token,
+// an agent or a remote service that can pick the right one in a single round
+// trip, or an identity that prompts the user and should only do so once.
+//
+// Decrypt calls UnwrapStanzas instead of Unwrap if it's implemented, with all
+// the stanzas regardless of their type. It must return ErrIncorrectIdentity
+// if none of the stanzas match the identity.
+type StanzasIdentity interface {
+	Identity
+	UnwrapStanzas(stanzas []*format.Recipient) (fileKey []byte, err error)
+}
+
 var ErrIncorrectIdentity = errors.New("incorrect identity for recipient block")
 
 type Recipient interface {
@@ -35,123 +48,351 @@ type Recipient interface {
 	Wrap(fileKey []byte) (*format.Recipient, error)
 }
 
+// RecipientWithLabels can be optionally implemented by a Recipient to declare
+// labels, such as "postquantum" or "passphrase", describing the security
+// properties of its stanzas.
+//
+// Encrypt requires all recipients of a file to have the same set of labels,
+// so that for example a post-quantum recipient can't be silently mixed with a
+// classical one. Recipients that don't implement this interface have an empty
+// set of labels.
+//
+// A recipient with the "passphrase" label must be the only recipient of a
+// file, to uphold the authentication implicitly expected of passphrase
+// encrypted files.
+type RecipientWithLabels interface {
+	Recipient
+	Labels() []string
+}
+
+// passphraseLabel is the label of recipients that must be the only one.
+const passphraseLabel = "passphrase"
+
+// payloadCiphers maps the supported format versions to their payload cipher.
+var payloadCiphers = map[string]stream.Cipher{
+	format.V1:       stream.ChaCha20Poly1305,
+	format.V1AESGCM: stream.AES256GCM,
+}
+
+// EncryptOptions are optional settings for EncryptWithOptions. The zero value
+// produces the same output as Encrypt.
+type EncryptOptions struct {
+	// Armor wraps the output in the ASCII armor format, like EncryptWithArmor.
+	Armor bool
+
+	// ExperimentalAESGCM selects the experimental format variant that uses
+	// AES-256-GCM for the payload. Files produced with it can't be decrypted
+	// by age-encryption.org/v1 implementations that don't support it.
+	ExperimentalAESGCM bool
+
+	// TestOnlyRand replaces crypto/rand as the source of all randomness, for
+	// the file key, the payload nonce, and the recipients implementing
+	// RecipientWithRand, to produce reproducible test vectors and fixtures.
+	//
+	// It is NEVER safe to use outside of tests, and to prevent accidental use
+	// it causes EncryptWithOptions to fail unless the program is built with
+	// the age_testrand build tag.
+	TestOnlyRand io.Reader
+
+	// Metadata, if set, is stored encrypted at the start of the payload, and
+	// returned by Header.Metadata and DecryptResult.Metadata.
+	//
+	// Implementations other than this package will not remove it from the
+	// decrypted plaintext.
+	Metadata *Metadata
+
+	// Compress, if set to "gzip" or "zstd", compresses the plaintext with that
+	// algorithm before encrypting it. Decrypt decompresses it automatically.
+	//
+	// Compression makes the size of the file depend on the contents, so it
+	// must not be used if the plaintext mixes secrets with data that could
+	// be influenced by an attacker who observes the file size. (See the
+	// CRIME and BREACH attacks.)
+	Compress string
+
+	// Pad, if set, returns the size to which a payload of the given size is
+	// padded, such as Padme or a function returned by PadToMultiple, to hide
+	// the exact size of the plaintext. The padding is removed on decryption.
+	// If Pad returns less than size, the Writer fails on Close.
+	Pad func(size int64) int64
+}
+
+// testOnlyRandAllowed is set by the age_testrand build tag, and by the tests.
+var testOnlyRandAllowed = false
+
+// RecipientWithRand can be optionally implemented by a Recipient that uses
+// randomness to wrap the file key, so that EncryptOptions.TestOnlyRand can
+// replace it. Recipients that don't implement it keep working as usual.
+type RecipientWithRand interface {
+	Recipient
+	WrapWithRand(fileKey []byte, rand io.Reader) (*format.Recipient, error)
+}
+
 func Encrypt(dst io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
-	// stream.Writer takes a WriteCloser, and will propagate Close calls (so
-	// that the ArmoredWriter will get closed), but we don't want to expose
-	// that behavior to our caller.
-	dstCloser := format.NopCloser(dst)
-	return encrypt(dstCloser, recipients...)
+	return EncryptWithOptions(dst, nil, recipients...)
 }
 
 func EncryptWithArmor(dst io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
-	dstCloser := format.ArmoredWriter(dst)
-	return encrypt(dstCloser, recipients...)
+	return EncryptWithOptions(dst, &EncryptOptions{Armor: true}, recipients...)
 }
 
-func encrypt(dst io.WriteCloser, recipients ...Recipient) (io.WriteCloser, error) {
+func EncryptWithOptions(dst io.Writer, opts *EncryptOptions, recipients ...Recipient) (io.WriteCloser, error) {
+	return EncryptContext(context.Background(), dst, opts, recipients...)
+}
+
+func encrypt(ctx context.Context, dst io.WriteCloser, opts *EncryptOptions, recipients ...Recipient) (io.WriteCloser, error) {
+	payloadCipher, payloadKey, err := encryptHeader(ctx, dst, opts, recipients)
+	if err != nil {
+		return nil, err
+	}
+	w, err := stream.NewWriterWithCipher(payloadCipher, payloadKey, dst)
+	if err != nil {
+		return nil, err
+	}
+	return wrapPayloadWriter(w, opts)
+}
+
+// encryptHeader writes the header and the payload nonce to dst, and returns
+// the cipher and key to encrypt the payload with.
+func encryptHeader(ctx context.Context, dst io.Writer, opts *EncryptOptions, recipients []Recipient) (stream.Cipher, []byte, error) {
 	if len(recipients) == 0 {
-		return nil, errors.New("no recipients specified")
+		return nil, nil, errors.New("no recipients specified")
+	}
+	if c := opts.Compress; c != "" && c != extGzip && c != extZstd {
+		return nil, nil, fmt.Errorf("unsupported compression algorithm %q", c)
+	}
+
+	random := rand.Reader
+	if opts.TestOnlyRand != nil {
+		if !testOnlyRandAllowed {
+			return nil, nil, errors.New("EncryptOptions.TestOnlyRand can only be used in programs built with the age_testrand tag")
+		}
+		random = opts.TestOnlyRand
 	}
 
 	fileKey := make([]byte, 16)
-	if _, err := rand.Read(fileKey); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(random, fileKey); err != nil {
+		return nil, nil, err
 	}
 
-	hdr := &format.Header{}
-	for i, r := range recipients {
-		if r.Type() == "scrypt" && len(recipients) != 1 {
-			return nil, errors.New("an scrypt recipient must be the only one")
+	labels := recipientLabels(recipients[0])
+	for i, r := range recipients[1:] {
+		if !labels.equal(recipientLabels(r)) {
+			return nil, nil, fmt.Errorf("recipient #%d (%s) can't be mixed with recipient #0 (%s)", i+1, r.Type(), recipients[0].Type())
 		}
+	}
+	if labels[passphraseLabel] && len(recipients) != 1 {
+		return nil, nil, fmt.Errorf("a %s recipient must be the only one", recipients[0].Type())
+	}
+	if labels[passphraseLabel] && len(opts.payloadExtensions()) > 0 {
+		return nil, nil, fmt.Errorf("a %s recipient can't be combined with compression, padding or metadata", recipients[0].Type())
+	}
 
-		block, err := r.Wrap(fileKey)
+	hdr := &format.Header{Version: format.V1}
+	if opts.ExperimentalAESGCM {
+		hdr.Version = format.V1AESGCM
+	}
+	for i, r := range recipients {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		var block *format.Recipient
+		var err error
+		if rr, ok := r.(RecipientWithRand); ok && opts.TestOnlyRand != nil {
+			block, err = rr.WrapWithRand(fileKey, random)
+		} else if rr, ok := r.(RecipientWithContext); ok {
+			block, err = rr.WrapContext(ctx, fileKey)
+		} else {
+			block, err = r.Wrap(fileKey)
+		}
+		if err != nil && ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to wrap key for recipient #%d: %v", i, err)
+			return nil, nil, fmt.Errorf("failed to wrap key for recipient #%d: %v", i, err)
 		}
 		hdr.Recipients = append(hdr.Recipients, block)
 	}
+	if exts := opts.payloadExtensions(); len(exts) > 0 {
+		hdr.Recipients = append(hdr.Recipients, &format.Recipient{Type: payloadStanzaType, Args: exts})
+	}
 	if mac, err := headerMAC(fileKey, hdr); err != nil {
-		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
+		return nil, nil, fmt.Errorf("failed to compute header MAC: %v", err)
 	} else {
 		hdr.MAC = mac
 	}
 	if err := hdr.Marshal(dst); err != nil {
-		return nil, fmt.Errorf("failed to write header: %v", err)
+		return nil, nil, fmt.Errorf("failed to write header: %v", err)
 	}
 
 	nonce := make([]byte, 16)
-	if _, err := rand.Read(nonce); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return nil, nil, err
 	}
 	if _, err := dst.Write(nonce); err != nil {
-		return nil, fmt.Errorf("failed to write nonce: %v", err)
+		return nil, nil, fmt.Errorf("failed to write nonce: %v", err)
 	}
 
-	return stream.NewWriter(streamKey(fileKey, nonce), dst)
+	return payloadCiphers[hdr.Version], streamKey(fileKey, nonce), nil
 }
 
-func Decrypt(src io.Reader, identities ...Identity) (io.Reader, error) {
-	if len(identities) == 0 {
-		return nil, errors.New("no identities specified")
+// unwrap returns the file key and the index of the stanza it was unwrapped
+// from if i can unwrap any of the stanzas, or ErrIncorrectIdentity if none of
+// them match. The index is -1 if it's unknown, see DecryptResult.
+func unwrap(ctx context.Context, i Identity, stanzas []*format.Recipient, p Prompter) ([]byte, int, error) {
+	if ip, ok := i.(PromptingIdentity); ok && p != nil {
+		fileKey, err := ip.UnwrapStanzasWithPrompter(ctx, stanzas, p)
+		return fileKey, soleMatch(i, stanzas), err
 	}
-
-	hdr, payload, err := format.Parse(src)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read header: %v", err)
+	if is, ok := i.(StanzasIdentityWithContext); ok {
+		fileKey, err := is.UnwrapStanzasContext(ctx, stanzas)
+		return fileKey, soleMatch(i, stanzas), err
 	}
-	if len(hdr.Recipients) > 20 {
-		return nil, errors.New("too many recipients")
+	if is, ok := i.(StanzasIdentity); ok {
+		fileKey, err := is.UnwrapStanzas(stanzas)
+		return fileKey, soleMatch(i, stanzas), err
 	}
-
-	var fileKey []byte
-RecipientsLoop:
-	for _, r := range hdr.Recipients {
-		if r.Type == "scrypt" && len(hdr.Recipients) != 1 {
-			return nil, errors.New("an scrypt recipient must be the only one")
+	for n, s := range stanzas {
+		if i.Type() != s.Type {
+			continue
 		}
-		for _, i := range identities {
-			if i.Type() != r.Type {
-				continue
-			}
 
-			if i, ok := i.(IdentityMatcher); ok {
-				err := i.Matches(r)
-				if err != nil {
-					if err == ErrIncorrectIdentity {
-						continue
-					}
-					return nil, err
-				}
+		if i, ok := i.(IdentityMatcher); ok {
+			err := i.Matches(s)
+			if err == ErrIncorrectIdentity {
+				continue
 			}
-
-			fileKey, err = i.Unwrap(r)
 			if err != nil {
-				if err == ErrIncorrectIdentity {
-					// TODO: we should collect these errors and return them as an
-					// []error type with an Error method. That will require turning
-					// ErrIncorrectIdentity into an interface or wrapper error.
-					continue
-				}
-				return nil, err
+				return nil, -1, err
 			}
+		}
 
-			break RecipientsLoop
+		var fileKey []byte
+		var err error
+		if ic, ok := i.(IdentityWithContext); ok {
+			fileKey, err = ic.UnwrapContext(ctx, s)
+		} else {
+			fileKey, err = i.Unwrap(s)
 		}
+		if err == ErrIncorrectIdentity {
+			continue
+		}
+		return fileKey, n, err
 	}
-	if fileKey == nil {
-		return nil, errors.New("no identity matched a recipient")
+	return nil, -1, ErrIncorrectIdentity
+}
+
+// soleMatch returns the index of the only stanza that i could have unwrapped,
+// based on its type and on IdentityMatcher, or -1 if there isn't exactly one.
+func soleMatch(i Identity, stanzas []*format.Recipient) int {
+	match := -1
+	for n, s := range stanzas {
+		if i.Type() != s.Type {
+			continue
+		}
+		if i, ok := i.(IdentityMatcher); ok && i.Matches(s) != nil {
+			continue
+		}
+		if match != -1 {
+			return -1
+		}
+		match = n
 	}
+	return match
+}
 
-	if mac, err := headerMAC(fileKey, hdr); err != nil {
-		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
-	} else if !hmac.Equal(mac, hdr.MAC) {
-		return nil, errors.New("bad header MAC")
+type labelSet map[string]bool
+
+func recipientLabels(r Recipient) labelSet {
+	s := make(labelSet)
+	if r, ok := r.(RecipientWithLabels); ok {
+		for _, l := range r.Labels() {
+			s[l] = true
+		}
 	}
+	return s
+}
 
-	nonce := make([]byte, 16)
-	if _, err := io.ReadFull(payload, nonce); err != nil {
-		return nil, fmt.Errorf("failed to read nonce: %v", err)
+func (s labelSet) equal(other labelSet) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for l := range s {
+		if !other[l] {
+			return false
+		}
 	}
+	return true
+}
+
+// DecryptOptions are optional settings for DecryptWithOptions. The zero
+// value is equivalent to Decrypt.
+type DecryptOptions struct {
+	// Prompter, if set, is passed to identities implementing
+	// PromptingIdentity, such as LazyScryptIdentity and EncryptedSSHIdentity,
+	// in place of their own.
+	Prompter Prompter
+
+	// MaxDecompressedSize is the maximum size of a decompressed payload, for
+	// files encrypted with EncryptOptions.Compress. If zero, the payload can
+	// be at most 100 times the size of the compressed data, plus 1 MiB. If
+	// negative, there is no limit. Exceeding the limit causes Read to return
+	// ErrDecompressionLimit.
+	MaxDecompressedSize int64
+}
+
+func Decrypt(src io.Reader, identities ...Identity) (io.Reader, error) {
+	return DecryptWithOptions(src, nil, identities...)
+}
+
+func DecryptWithOptions(src io.Reader, opts *DecryptOptions, identities ...Identity) (io.Reader, error) {
+	r, _, err := decrypt(context.Background(), src, opts, identities...)
+	return r, err
+}
+
+// DecryptResult describes how DecryptWithResult decrypted a file.
+type DecryptResult struct {
+	// Header is the parsed header of the file.
+	Header *format.Header
+
+	// StanzaIndex is the index in Header.Recipients of the stanza that was
+	// unwrapped. If Identity implements StanzasIdentity and more than one
+	// stanza could have matched it, StanzaIndex is -1.
+	StanzaIndex int
+
+	// StanzaType is the type of the unwrapped stanza, or Identity.Type() if
+	// StanzaIndex is -1.
+	StanzaType string
 
-	return stream.NewReader(streamKey(fileKey, nonce), payload)
+	// Identity is the identity that unwrapped the file key, one of those
+	// passed to DecryptWithResult.
+	Identity Identity
+
+	// Metadata is the metadata record stored with EncryptOptions.Metadata, or
+	// nil if the file doesn't have one.
+	Metadata *Metadata
+}
+
+// DecryptWithResult is like DecryptWithOptions, but also reports which
+// identity and stanza were used to decrypt the file, for example to find out
+// when old keys stop being used.
+func DecryptWithResult(src io.Reader, opts *DecryptOptions, identities ...Identity) (io.Reader, *DecryptResult, error) {
+	return decrypt(context.Background(), src, opts, identities...)
+}
+
+func decrypt(ctx context.Context, src io.Reader, opts *DecryptOptions, identities ...Identity) (io.Reader, *DecryptResult, error) {
+	h, err := ParseHeader(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileKey, res, err := h.unwrap(ctx, opts, identities)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := h.Open(fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	res.Metadata = h.metadata
+	return r, res, nil
 }
@@ -8,13 +8,24 @@ package age_test
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
 	"io"
 	"io/ioutil"
+	"math"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"filippo.io/age/internal/age"
+	"filippo.io/age/internal/format"
+	"filippo.io/age/internal/stream"
+	"golang.org/x/crypto/chacha20"
 	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
 )
 
 const helloWorld = "Hello, Twitch!"
@@ -104,3 +115,884 @@ func TestEncryptDecryptScrypt(t *testing.T) {
 		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
 	}
 }
+
+func TestScryptPayloadExtensions(t *testing.T) {
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	for name, opts := range map[string]*age.EncryptOptions{
+		"compress": {Compress: "zstd"},
+		"pad":      {Pad: age.Padme},
+		"metadata": {Metadata: &age.Metadata{Name: "file.txt"}},
+	} {
+		// The payload stanza would make the file unreadable by other
+		// implementations, which require the scrypt stanza to be alone.
+		if _, err := age.EncryptWithOptions(ioutil.Discard, opts, r); err == nil {
+			t.Errorf("%s: scrypt recipient accepted with payload extensions", name)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	hdr := &format.Header{Recipients: []*format.Recipient{
+		{Type: "scrypt", Args: []string{"c2FsdHNhbHRzYWx0c2FsdA", "10"}, Body: make([]byte, 32)},
+		{Type: "x-payload", Args: []string{"pad"}},
+	}, MAC: make([]byte, 32)}
+	if err := hdr.Marshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := age.ParseHeader(buf); err == nil {
+		t.Error("scrypt stanza with a payload stanza was accepted")
+	}
+}
+
+const aesGCMVectorIdentity = "AGE-SECRET-KEY-1EJS8XMR5KMXEG044VDURKVWQ38GPLCC84SK2JPAZC6E48ZV3K3AQ070Q7F"
+
+const aesGCMVector = `-----BEGIN AGE ENCRYPTED FILE-----
+YWdlLWVuY3J5cHRpb24ub3JnL3YxLWFlcy0yNTYtZ2NtCi0+IFgyNTUxOSBEVHNJ
+ek9ra0dDU2kyelh2OWwwckV1U3VLWDlhSnJNSkY1MFNnblIzUEdvClRhSW9ZM2hB
+eVprODI4aEZqdlVIUkNJZ2x3enpZanBtWllqN09ldDMvS2cKLS0tIFJOb0tWZWlH
+TVVLVzRqUG1kR3VJR0VOYlRkZ2tQTzYxNUhMRG1Hb2FZMVkK3wpru+WiqxdKtZD5
+n0du313jYU1wZ9YnaIQkwDmLBQgg+6gTpcRC7Vr96rf1LsrT47zuOsw2dfw=
+-----END AGE ENCRYPTED FILE-----
+`
+
+func TestAESGCMVector(t *testing.T) {
+	i, err := age.ParseX25519Identity(aesGCMVectorIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := age.Decrypt(strings.NewReader(aesGCMVector), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != "age AES-GCM test vector\n" {
+		t.Errorf("wrong data: %q", outBytes)
+	}
+}
+
+func TestEncryptDecryptAESGCM(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithOptions(buf, &age.EncryptOptions{ExperimentalAESGCM: true}, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "age-encryption.org/v1-aes-256-gcm\n") {
+		t.Errorf("unexpected intro line: %q", buf.String())
+	}
+
+	out, err := age.Decrypt(buf, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+}
+
+type labeledRecipient struct {
+	*age.X25519Recipient
+	labels []string
+}
+
+func (r labeledRecipient) Labels() []string { return r.labels }
+
+func TestLabels(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	classical := i.Recipient()
+	pq := labeledRecipient{classical, []string{"postquantum"}}
+	pq2 := labeledRecipient{classical, []string{"postquantum", "postquantum"}}
+	scrypt, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrypt2, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		recipients []age.Recipient
+		ok         bool
+	}{
+		{"classical", []age.Recipient{classical, classical}, true},
+		{"postquantum", []age.Recipient{pq, pq2}, true},
+		{"mixed", []age.Recipient{pq, classical}, false},
+		{"mixed reverse", []age.Recipient{classical, pq}, false},
+		{"scrypt and classical", []age.Recipient{scrypt, classical}, false},
+		{"two scrypt", []age.Recipient{scrypt, scrypt2}, false},
+		{"same scrypt twice", []age.Recipient{scrypt, scrypt}, false},
+		{"passphrase label", []age.Recipient{labeledRecipient{classical, []string{"passphrase"}}, classical}, false},
+		{"passphrase label twice", []age.Recipient{
+			labeledRecipient{classical, []string{"passphrase"}},
+			labeledRecipient{classical, []string{"passphrase"}}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := age.Encrypt(ioutil.Discard, tc.recipients...)
+			if tc.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("incompatible recipients were accepted")
+			}
+		})
+	}
+}
+
+type countingIdentity struct {
+	*age.X25519Identity
+	calls int
+}
+
+func (i *countingIdentity) UnwrapStanzas(stanzas []*format.Recipient) ([]byte, error) {
+	i.calls++
+	for _, s := range stanzas {
+		if fileKey, err := i.Unwrap(s); err == nil {
+			return fileKey, nil
+		}
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+func TestUnwrapStanzas(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, a.Recipient(), b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i := &countingIdentity{X25519Identity: b}
+	if _, err := age.Decrypt(buf, i); err != nil {
+		t.Fatal(err)
+	}
+	if i.calls != 1 {
+		t.Errorf("UnwrapStanzas called %d times, expected once", i.calls)
+	}
+}
+
+func TestDecryptWithResult(t *testing.T) {
+	var ids []*age.X25519Identity
+	var rs []age.Recipient
+	for n := 0; n < 4; n++ {
+		i, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, i)
+		rs = append(rs, i.Recipient())
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, rs[:3]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	_, res, err := age.DecryptWithResult(bytes.NewReader(file), nil, ids[3], ids[2], ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Identity != ids[2] || res.StanzaIndex != 2 || res.StanzaType != "X25519" {
+		t.Errorf("got identity %p, stanza #%d (%s), expected %p, stanza #2 (X25519)",
+			res.Identity, res.StanzaIndex, res.StanzaType, ids[2])
+	}
+	if len(res.Header.Recipients) != 3 {
+		t.Errorf("got %d stanzas in the header, expected 3", len(res.Header.Recipients))
+	}
+
+	i := &countingIdentity{X25519Identity: ids[1]}
+	_, res, err = age.DecryptWithResult(bytes.NewReader(file), nil, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Identity != i || res.StanzaIndex != -1 || res.StanzaType != "X25519" {
+		t.Errorf("got stanza #%d (%s), expected an unknown X25519 stanza", res.StanzaIndex, res.StanzaType)
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	a, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithArmor(buf, a.Recipient(), b.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	h, err := age.ParseHeader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Stanzas()) != 2 || h.Stanzas()[1].Type != "X25519" {
+		t.Fatalf("unexpected stanzas: %v", h.Stanzas())
+	}
+	if _, err := h.Open(make([]byte, 16)); err == nil {
+		t.Error("Open succeeded with the wrong file key")
+	}
+	fileKey, err := h.Unwrap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := h.Open(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+
+	h, err = age.ParseHeader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = h.Decrypt(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err = ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+}
+
+func TestPosition(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 3*stream.ChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	hdrLen := bytes.Index(file, []byte("\n---")) + 1
+	hdrLen += bytes.IndexByte(file[hdrLen:], '\n') + 1
+	encChunkSize := int64(stream.ChunkSize + 16)
+	secondChunk := int64(hdrLen) + 16 + encChunkSize
+
+	h, err := age.ParseHeader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := h.Decrypt(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk, offset := h.Position(); chunk != 0 || offset != int64(hdrLen)+16 {
+		t.Errorf("got position %d/%d before reading, expected 0/%d", chunk, offset, hdrLen+16)
+	}
+	if n, err := io.Copy(ioutil.Discard, r); err != nil || n != 3*stream.ChunkSize {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if chunk, _ := h.Position(); chunk != 3 {
+		t.Errorf("got chunk %d at the end, expected 3", chunk)
+	}
+
+	file[secondChunk+100] ^= 0xff
+	h, err = age.ParseHeader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = h.Decrypt(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, r)
+	if err == nil {
+		t.Fatal("damaged file decrypted successfully")
+	}
+	var authErr *age.ErrChunkAuthentication
+	if !errors.As(err, &authErr) || authErr.Index != 1 {
+		t.Errorf("got error %v, expected an authentication failure of chunk 1", err)
+	}
+	if n != stream.ChunkSize {
+		t.Errorf("got %d bytes before the damaged chunk, expected %d", n, stream.ChunkSize)
+	}
+	if chunk, offset := h.Position(); chunk != 1 || offset != secondChunk {
+		t.Errorf("got position %d/%d, expected 1/%d", chunk, offset, secondChunk)
+	}
+}
+
+func TestDecryptWithFileKey(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	h, err := age.ParseHeader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKey, err := h.Unwrap(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := age.DecryptWithFileKey(bytes.NewReader(file), make([]byte, 16)); err == nil {
+		t.Error("DecryptWithFileKey succeeded with the wrong file key")
+	}
+	out, err := age.DecryptWithFileKey(bytes.NewReader(file), fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+}
+
+func TestEncryptReaderDecryptWriter(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, 5*64*1024/2)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := age.EncryptReader(bytes.NewReader(plaintext), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := age.Decrypt(bytes.NewReader(file), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(outBytes, plaintext) {
+		t.Error("EncryptReader output decrypted to the wrong plaintext")
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := age.DecryptWriter(buf, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for c := file; len(c) > 0; {
+		n := 7
+		if n > len(c) {
+			n = len(c)
+		}
+		if _, err := w.Write(c[:n]); err != nil {
+			t.Fatal(err)
+		}
+		c = c[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), plaintext) {
+		t.Error("DecryptWriter wrote the wrong plaintext")
+	}
+
+	w, err = age.DecryptWriter(ioutil.Discard, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(file[:len(file)-20]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Error("DecryptWriter accepted a truncated file")
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := age.Seal([]byte(helloWorld), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := age.Decrypt(bytes.NewReader(ciphertext), i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+
+	saved := append([]byte{}, ciphertext...)
+	plaintext, err := age.Open(ciphertext, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", plaintext, helloWorld)
+	}
+	if !bytes.Equal(ciphertext, saved) {
+		t.Error("Open modified the ciphertext")
+	}
+
+	col := age.EncryptedColumn{Plaintext: []byte(helloWorld), Recipients: []age.Recipient{i.Recipient()}}
+	v, err := col.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned := &age.EncryptedColumn{Identities: []age.Identity{i}}
+	if err := scanned.Scan(v); err != nil {
+		t.Fatal(err)
+	}
+	if string(scanned.Plaintext) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", scanned.Plaintext, helloWorld)
+	}
+	if err := scanned.Scan(nil); err != nil || scanned.Plaintext != nil {
+		t.Errorf("scanning NULL returned %q, %v", scanned.Plaintext, err)
+	}
+}
+
+type countingPrompter struct {
+	age.StaticPrompter
+	requests int
+}
+
+func (p *countingPrompter) RequestSecret(message string) ([]byte, error) {
+	p.requests++
+	return p.StaticPrompter.RequestSecret(message)
+}
+
+func TestMetadata(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &age.Metadata{
+		Name:        "report.pdf",
+		Mode:        0640,
+		ModTime:     time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC),
+		ContentType: "application/pdf",
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithOptions(buf, &age.EncryptOptions{Metadata: m}, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	r, res, err := age.DecryptWithResult(bytes.NewReader(file), nil, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", out, helloWorld)
+	}
+	if res.Metadata == nil || *res.Metadata != *m {
+		t.Errorf("got metadata %+v, expected %+v", res.Metadata, m)
+	}
+
+	out, err = age.Open(file, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != helloWorld {
+		t.Errorf("Open: wrong data: %q, excepted %q", out, helloWorld)
+	}
+
+	// Files without metadata don't have a payload stanza.
+	buf = &bytes.Buffer{}
+	w, err = age.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("x-payload")) {
+		t.Error("file without extensions has a payload stanza")
+	}
+	_, res, err = age.DecryptWithResult(buf, nil, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Metadata != nil {
+		t.Errorf("got metadata %+v for a file without it", res.Metadata)
+	}
+
+	// The payload stanza is authenticated by the header MAC.
+	for _, tampered := range [][]byte{
+		bytes.Replace(file, []byte("-> x-payload metadata\n"), []byte("-> x-payload\n"), 1),
+		bytes.Replace(file, []byte("-> x-payload metadata\n"), []byte("-> x-other metadata\n"), 1),
+	} {
+		if bytes.Equal(tampered, file) {
+			t.Fatal("payload stanza not found")
+		}
+		if _, err := age.Decrypt(bytes.NewReader(tampered), i); err == nil {
+			t.Error("decrypted a file with a tampered payload stanza")
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(t *testing.T, opts *age.EncryptOptions, plaintext []byte) []byte {
+		buf := &bytes.Buffer{}
+		w, err := age.EncryptWithOptions(buf, opts, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	text := []byte(strings.Repeat("All work and no play makes Jack a dull boy.\n", 10000))
+
+	for _, alg := range []string{"gzip", "zstd"} {
+		t.Run(alg, func(t *testing.T) {
+			m := &age.Metadata{Name: "jack.txt"}
+			file := encrypt(t, &age.EncryptOptions{Compress: alg, Metadata: m}, text)
+			if len(file) > len(text)/10 {
+				t.Errorf("compressed file is %d bytes, plaintext is %d", len(file), len(text))
+			}
+			r, res, err := age.DecryptWithResult(bytes.NewReader(file), nil, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, text) {
+				t.Error("wrong decompressed data")
+			}
+			if res.Metadata == nil || res.Metadata.Name != m.Name {
+				t.Errorf("got metadata %+v, expected %+v", res.Metadata, m)
+			}
+
+			zeroes := make([]byte, 32<<20)
+			file = encrypt(t, &age.EncryptOptions{Compress: alg}, zeroes)
+			// With the default limit, a compression bomb fails too.
+			for _, limit := range []int64{1 << 20, 0} {
+				opts := &age.DecryptOptions{MaxDecompressedSize: limit}
+				r, err := age.DecryptWithOptions(bytes.NewReader(file), opts, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.Copy(ioutil.Discard, r); err != age.ErrDecompressionLimit {
+					t.Errorf("limit %d: got error %v, expected ErrDecompressionLimit", limit, err)
+				}
+			}
+			r, err = age.DecryptWithOptions(bytes.NewReader(file), &age.DecryptOptions{MaxDecompressedSize: -1}, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n, err := io.Copy(ioutil.Discard, r); err != nil || n != int64(len(zeroes)) {
+				t.Errorf("no limit: got %d bytes and error %v", n, err)
+			}
+		})
+	}
+
+	if _, err := age.EncryptWithOptions(ioutil.Discard, &age.EncryptOptions{Compress: "lz4"}, i.Recipient()); err == nil {
+		t.Error("unsupported compression algorithm was accepted")
+	}
+}
+
+func TestPadme(t *testing.T) {
+	for size, expected := range map[int64]int64{
+		0: 0, 1: 1, 2: 2, 9: 10, 1000: 1024, 1025: 1088, 100000: 100352,
+	} {
+		if got := age.Padme(size); got != expected {
+			t.Errorf("Padme(%d) = %d, expected %d", size, got, expected)
+		}
+	}
+	for size := int64(0); size < 1<<20; size += 997 {
+		if p := age.Padme(size); p < size || p > size+size*12/100+1 {
+			t.Errorf("Padme(%d) = %d", size, p)
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(t *testing.T, pad func(int64) int64, plaintext []byte) []byte {
+		buf := &bytes.Buffer{}
+		w, err := age.EncryptWithOptions(buf, &age.EncryptOptions{Pad: pad}, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	big := make([]byte, 200*1024)
+	rand.Read(big)
+	for name, plaintext := range map[string][]byte{
+		"empty":        {},
+		"marker":       {0x80},
+		"marker zeros": {0x80, 0, 0, 0x80, 0, 0},
+		"zeros":        make([]byte, 100000),
+		"marker chunk": append(append([]byte("x\x80"), make([]byte, 64*1024)...), 0x80, 1),
+		"random":       big,
+	} {
+		for _, pad := range []func(int64) int64{age.Padme, age.PadToMultiple(4096)} {
+			file := encrypt(t, pad, plaintext)
+			r, err := age.Decrypt(bytes.NewReader(file), i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(iotest.OneByteReader(r))
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			if !bytes.Equal(out, plaintext) {
+				t.Errorf("%s: got %d bytes, expected %d", name, len(out), len(plaintext))
+			}
+			out, err = age.Open(file, i)
+			if err != nil || !bytes.Equal(out, plaintext) {
+				t.Errorf("%s: Open failed: %v", name, err)
+			}
+		}
+	}
+
+	a := encrypt(t, age.PadToMultiple(4096), []byte("yes"))
+	b := encrypt(t, age.PadToMultiple(4096), []byte("no"))
+	if len(a) != len(b) {
+		t.Errorf("padded files have different sizes: %d and %d", len(a), len(b))
+	}
+
+	if got := age.PadToMultiple(math.MaxInt64 - 1)(2); got != math.MaxInt64-1 {
+		t.Errorf("PadToMultiple(MaxInt64-1)(2) = %d", got)
+	}
+	if got := age.PadToMultiple(1 << 62)(1<<62 + 1); got != -1 {
+		t.Errorf("PadToMultiple(1<<62)(1<<62+1) = %d, expected -1", got)
+	}
+	w, err := age.EncryptWithOptions(ioutil.Discard, &age.EncryptOptions{
+		Pad: func(size int64) int64 { return -1 },
+	}, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("yes")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close succeeded without padding")
+	}
+}
+
+func TestLazyScryptIdentityPrompter(t *testing.T) {
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(15)
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, helloWorld); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := buf.Bytes()
+
+	if _, err := age.Decrypt(bytes.NewReader(ciphertext), &age.LazyScryptIdentity{}); err == nil {
+		t.Error("decryption succeeded without a Prompter")
+	}
+
+	p := &countingPrompter{StaticPrompter: age.StaticPrompter{Secret: []byte("password")}}
+	opts := &age.DecryptOptions{Prompter: p}
+	out, err := age.DecryptWithOptions(bytes.NewReader(ciphertext), opts, &age.LazyScryptIdentity{Prompter: age.DenyPrompter{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outBytes, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outBytes) != helloWorld {
+		t.Errorf("wrong data: %q, excepted %q", outBytes, helloWorld)
+	}
+	if p.requests != 1 {
+		t.Errorf("passphrase requested %d times, expected once", p.requests)
+	}
+
+	p = &countingPrompter{StaticPrompter: age.StaticPrompter{Secret: []byte("wrong")}}
+	opts = &age.DecryptOptions{Prompter: p}
+	if _, err := age.DecryptWithOptions(bytes.NewReader(ciphertext), opts, &age.LazyScryptIdentity{}); err == nil {
+		t.Error("decryption succeeded with the wrong passphrase")
+	}
+}
+
+func newTestRand() io.Reader {
+	c, err := chacha20.NewUnauthenticatedCipher(make([]byte, 32), make([]byte, 12))
+	if err != nil {
+		panic(err)
+	}
+	return cipher.StreamReader{S: c, R: zeroReader{}}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestTestOnlyRand(t *testing.T) {
+	x25519, err := age.NewX25519Identity(make([]byte, curve25519.ScalarSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	edPub, err := ssh.NewPublicKey(edKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshEd25519, err := age.NewSSHEd25519Recipient(edPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrypt, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrypt.SetWorkFactor(10)
+
+	for _, rs := range [][]age.Recipient{
+		{x25519.Recipient(), sshEd25519},
+		{scrypt},
+	} {
+		var outputs [2][]byte
+		for i := range outputs {
+			buf := &bytes.Buffer{}
+			opts := &age.EncryptOptions{TestOnlyRand: newTestRand()}
+			w, err := age.EncryptWithOptions(buf, opts, rs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(w, helloWorld); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			outputs[i] = buf.Bytes()
+		}
+		if !bytes.Equal(outputs[0], outputs[1]) {
+			t.Errorf("%s: encryption is not reproducible", rs[0].Type())
+		}
+	}
+}
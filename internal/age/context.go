@@ -0,0 +1,126 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"context"
+	"io"
+
+	"filippo.io/age/internal/format"
+	"filippo.io/age/internal/stream"
+)
+
+// RecipientWithContext can be optionally implemented by a Recipient whose
+// Wrap might block, such as one backed by a remote service, or that is slow,
+// like ScryptRecipient. EncryptContext calls WrapContext instead of Wrap.
+type RecipientWithContext interface {
+	Recipient
+	WrapContext(ctx context.Context, fileKey []byte) (*format.Recipient, error)
+}
+
+// IdentityWithContext can be optionally implemented by an Identity whose
+// Unwrap might block or be slow. DecryptContext calls UnwrapContext instead of
+// Unwrap. It's not used for identities implementing StanzasIdentity.
+type IdentityWithContext interface {
+	Identity
+	UnwrapContext(ctx context.Context, block *format.Recipient) (fileKey []byte, err error)
+}
+
+// StanzasIdentityWithContext can be optionally implemented by a
+// StanzasIdentity, such as one backed by a hardware token or a remote service.
+// DecryptContext calls UnwrapStanzasContext instead of UnwrapStanzas.
+type StanzasIdentityWithContext interface {
+	StanzasIdentity
+	UnwrapStanzasContext(ctx context.Context, stanzas []*format.Recipient) (fileKey []byte, err error)
+}
+
+// EncryptContext is like EncryptWithOptions, but passes ctx to recipients
+// implementing RecipientWithContext, and makes the returned Writer fail with
+// ctx.Err() once ctx is done. Writes are checked between chunks, so a large
+// Write can be interrupted half-way. If ctx is done, Close doesn't finalize
+// the file, which will then fail to decrypt.
+func EncryptContext(ctx context.Context, dst io.Writer, opts *EncryptOptions, recipients ...Recipient) (io.WriteCloser, error) {
+	if opts == nil {
+		opts = &EncryptOptions{}
+	}
+	// stream.Writer takes a WriteCloser, and will propagate Close calls (so
+	// that the ArmoredWriter will get closed), but we don't want to expose
+	// that behavior to our caller.
+	dstCloser := format.NopCloser(dst)
+	if opts.Armor {
+		dstCloser = format.ArmoredWriter(dst)
+	}
+	w, err := encrypt(ctx, dstCloser, opts, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return w, nil
+	}
+	return &contextWriter{ctx: ctx, w: w}, nil
+}
+
+// DecryptContext is like DecryptWithOptions, but passes ctx to identities
+// implementing IdentityWithContext, and makes the returned Reader fail with
+// ctx.Err() once ctx is done, which is checked before reading each chunk.
+func DecryptContext(ctx context.Context, src io.Reader, opts *DecryptOptions, identities ...Identity) (io.Reader, error) {
+	r, _, err := decrypt(ctx, src, opts, identities...)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return r, nil
+	}
+	return &contextReader{ctx: ctx, r: r}, nil
+}
+
+// contextReader checks ctx before every Read. stream.Reader never reads more
+// than one chunk per call, so that's also a check between chunks.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// contextWriter splits writes in chunk-sized pieces, and checks ctx before
+// each of them and before closing.
+type contextWriter struct {
+	ctx context.Context
+	w   io.WriteCloser
+}
+
+func (w *contextWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if err := w.ctx.Err(); err != nil {
+			return n, err
+		}
+		chunk := p
+		if len(chunk) > stream.ChunkSize {
+			chunk = chunk[:stream.ChunkSize]
+		}
+		nn, err := w.w.Write(chunk)
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (w *contextWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	return w.w.Close()
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"filippo.io/age/internal/age"
+	"filippo.io/age/internal/format"
+	"filippo.io/age/internal/stream"
+)
+
+// blockingIdentity never unwraps a stanza, and blocks until ctx is done.
+type blockingIdentity struct{}
+
+func (blockingIdentity) Type() string { return "X25519" }
+
+func (blockingIdentity) Unwrap(block *format.Recipient) ([]byte, error) {
+	panic("Unwrap called instead of UnwrapContext")
+}
+
+func (blockingIdentity) UnwrapContext(ctx context.Context, block *format.Recipient) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDecryptContext(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 3*stream.ChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = age.DecryptContext(ctx, bytes.NewReader(file), nil, blockingIdentity{}, i)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded from a blocking identity, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	out, err := age.DecryptContext(ctx, bytes.NewReader(file), nil, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(out, make([]byte, stream.ChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := out.Read(make([]byte, stream.ChunkSize)); err != context.Canceled {
+		t.Errorf("expected Canceled after the first chunk, got %v", err)
+	}
+}
+
+func TestEncryptContext(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptContext(ctx, buf, nil, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, stream.ChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if n, err := w.Write(make([]byte, stream.ChunkSize)); err != context.Canceled || n != 0 {
+		t.Errorf("expected Canceled after the first chunk, got %d, %v", n, err)
+	}
+	if err := w.Close(); err != context.Canceled {
+		t.Errorf("expected Canceled from Close, got %v", err)
+	}
+
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(18)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := age.EncryptContext(ctx, buf, nil, r); err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded from scrypt, got %v", err)
+	}
+}
+
+func TestDecryptContextLazyScrypt(t *testing.T) {
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Raise the work factor, so that scrypt runs long enough to be cancelled.
+	// The header MAC is only checked after the file key is unwrapped.
+	file := bytes.Replace(buf.Bytes(), []byte(" 10\n"), []byte(" 18\n"), 1)
+
+	p := &age.StaticPrompter{Secret: []byte("password")}
+	for name, opts := range map[string]*age.DecryptOptions{
+		"identity prompter": nil,
+		"options prompter":  {Prompter: p},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			i := &age.LazyScryptIdentity{Prompter: p}
+			_, err := age.DecryptContext(ctx, bytes.NewReader(file), opts, i)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected DeadlineExceeded from scrypt, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/ssh"
+)
+
+// EncryptedSSHIdentity is a passphrase protected SSH private key. The key is
+// only decrypted once a stanza matching its public key is found, requesting
+// the passphrase from a Prompter, and then kept decrypted.
+type EncryptedSSHIdentity struct {
+	pubKey   ssh.PublicKey
+	pemBytes []byte
+	name     string
+
+	// Prompter is used to request the passphrase, unless one is passed to
+	// DecryptWithOptions. If nil, DenyPrompter is used.
+	Prompter Prompter
+
+	decrypted Identity
+}
+
+// NewEncryptedSSHIdentity returns an EncryptedSSHIdentity for the PEM encoded
+// private key pemBytes, which must match pubKey.
+func NewEncryptedSSHIdentity(pubKey ssh.PublicKey, pemBytes []byte) (*EncryptedSSHIdentity, error) {
+	switch t := pubKey.Type(); t {
+	case "ssh-ed25519", "ssh-rsa":
+	default:
+		return nil, fmt.Errorf("unsupported SSH key type: %v", t)
+	}
+	return &EncryptedSSHIdentity{
+		pubKey:   pubKey,
+		pemBytes: pemBytes,
+		name:     "SSH key " + ssh.FingerprintSHA256(pubKey),
+	}, nil
+}
+
+// SetName sets the name used to refer to the key when requesting its
+// passphrase, such as the name of the file it was loaded from. It defaults to
+// the public key fingerprint.
+func (i *EncryptedSSHIdentity) SetName(name string) {
+	i.name = name
+}
+
+// PublicKey returns the public key corresponding to the encrypted key.
+func (i *EncryptedSSHIdentity) PublicKey() ssh.PublicKey {
+	return i.pubKey
+}
+
+var _ IdentityMatcher = &EncryptedSSHIdentity{}
+var _ PromptingIdentity = &EncryptedSSHIdentity{}
+var _ StanzasIdentityWithContext = &EncryptedSSHIdentity{}
+
+func (i *EncryptedSSHIdentity) Type() string {
+	return i.pubKey.Type()
+}
+
+func (i *EncryptedSSHIdentity) Unwrap(block *format.Recipient) (fileKey []byte, err error) {
+	if err := i.decrypt(prompterOrDeny(i.Prompter)); err != nil {
+		return nil, err
+	}
+	return i.decrypted.Unwrap(block)
+}
+
+// UnwrapStanzas only prompts for the passphrase if one of the stanzas matches
+// the public key, and then tries all the matching ones.
+func (i *EncryptedSSHIdentity) UnwrapStanzas(stanzas []*format.Recipient) (fileKey []byte, err error) {
+	return i.UnwrapStanzasContext(context.Background(), stanzas)
+}
+
+func (i *EncryptedSSHIdentity) UnwrapStanzasContext(ctx context.Context, stanzas []*format.Recipient) (fileKey []byte, err error) {
+	return i.UnwrapStanzasWithPrompter(ctx, stanzas, prompterOrDeny(i.Prompter))
+}
+
+func (i *EncryptedSSHIdentity) UnwrapStanzasWithPrompter(ctx context.Context, stanzas []*format.Recipient, p Prompter) (fileKey []byte, err error) {
+	var matching []*format.Recipient
+	for _, s := range stanzas {
+		switch err := i.Matches(s); err {
+		case nil:
+			matching = append(matching, s)
+		case ErrIncorrectIdentity:
+		default:
+			return nil, err
+		}
+	}
+	if len(matching) == 0 {
+		return nil, ErrIncorrectIdentity
+	}
+
+	if err := i.decrypt(p); err != nil {
+		return nil, err
+	}
+	// The user might have given up while being prompted.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, s := range matching {
+		fileKey, err := i.decrypted.Unwrap(s)
+		if err == ErrIncorrectIdentity {
+			continue
+		}
+		return fileKey, err
+	}
+	return nil, ErrIncorrectIdentity
+}
+
+// decrypt requests the passphrase and decrypts the private key, if it wasn't
+// already decrypted.
+func (i *EncryptedSSHIdentity) decrypt(p Prompter) error {
+	if i.decrypted != nil {
+		return nil
+	}
+
+	passphrase, err := p.RequestSecret(fmt.Sprintf("Enter passphrase for %s", i.name))
+	if err != nil {
+		return fmt.Errorf("failed to obtain passphrase for %s: %v", i.name, err)
+	}
+	k, err := ssh.ParseRawPrivateKeyWithPassphrase(i.pemBytes, passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt SSH key file: %v", err)
+	}
+
+	var decrypted Identity
+	switch k := k.(type) {
+	case *ed25519.PrivateKey:
+		decrypted, err = NewSSHEd25519Identity(*k)
+	case *rsa.PrivateKey:
+		decrypted, err = NewSSHRSAIdentity(k)
+	default:
+		return fmt.Errorf("unexpected SSH key type: %T", k)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid SSH key: %v", err)
+	}
+	if decrypted.Type() != i.pubKey.Type() {
+		return fmt.Errorf("mismatched SSH key type: got %q, expected %q", decrypted.Type(), i.pubKey.Type())
+	}
+
+	i.decrypted = decrypted
+	return nil
+}
+
+func (i *EncryptedSSHIdentity) Matches(block *format.Recipient) error {
+	if block.Type != i.Type() {
+		return ErrIncorrectIdentity
+	}
+	if len(block.Args) < 1 {
+		return fmt.Errorf("invalid %v recipient block", i.Type())
+	}
+
+	if block.Args[0] != SSHFingerprint(i.pubKey) {
+		return ErrIncorrectIdentity
+	}
+	return nil
+}
+
+// LazyScryptIdentity is an scrypt identity that requests the passphrase from
+// a Prompter only if the file is passphrase encrypted.
+type LazyScryptIdentity struct {
+	// Prompter is used to request the passphrase, unless one is passed to
+	// DecryptWithOptions. If nil, DenyPrompter is used.
+	Prompter Prompter
+}
+
+var _ PromptingIdentity = &LazyScryptIdentity{}
+var _ StanzasIdentityWithContext = &LazyScryptIdentity{}
+
+func (i *LazyScryptIdentity) Type() string {
+	return "scrypt"
+}
+
+// UnwrapStanzas prompts for the passphrase only if there is an scrypt stanza.
+func (i *LazyScryptIdentity) UnwrapStanzas(stanzas []*format.Recipient) (fileKey []byte, err error) {
+	return i.UnwrapStanzasContext(context.Background(), stanzas)
+}
+
+func (i *LazyScryptIdentity) UnwrapStanzasContext(ctx context.Context, stanzas []*format.Recipient) (fileKey []byte, err error) {
+	return i.UnwrapStanzasWithPrompter(ctx, stanzas, prompterOrDeny(i.Prompter))
+}
+
+func (i *LazyScryptIdentity) UnwrapStanzasWithPrompter(ctx context.Context, stanzas []*format.Recipient, p Prompter) (fileKey []byte, err error) {
+	for _, s := range stanzas {
+		if s.Type == "scrypt" {
+			// There can only be one scrypt stanza.
+			return i.unwrap(ctx, s, p)
+		}
+	}
+	return nil, ErrIncorrectIdentity
+}
+
+func (i *LazyScryptIdentity) Unwrap(block *format.Recipient) (fileKey []byte, err error) {
+	return i.unwrap(context.Background(), block, prompterOrDeny(i.Prompter))
+}
+
+func (i *LazyScryptIdentity) unwrap(ctx context.Context, block *format.Recipient, p Prompter) (fileKey []byte, err error) {
+	pass, err := p.RequestSecret("Enter passphrase")
+	if err != nil {
+		return nil, fmt.Errorf("could not read passphrase: %v", err)
+	}
+	ii, err := NewScryptIdentity(string(pass))
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err = ii.UnwrapContext(ctx, block)
+	if err == ErrIncorrectIdentity {
+		// The API will just ignore the identity if the passphrase is wrong, and
+		// move on, eventually returning "no identity matched a recipient".
+		// Since this is usually the only identity for a passphrase encrypted
+		// file, make it a fatal error with a better message.
+		return nil, fmt.Errorf("incorrect passphrase")
+	}
+	return fileKey, err
+}
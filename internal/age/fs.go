@@ -0,0 +1,333 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"filippo.io/age/internal/stream"
+)
+
+// FS is an fs.FS that exposes the files of another fs.FS with a ".age"
+// extension decrypted, under their name without the extension. The encrypted
+// files themselves are hidden, and take precedence over any file with the
+// same name as their decrypted version.
+//
+// Decrypted files implement io.ReaderAt and io.Seeker. Unless they are
+// armored, or the underlying files don't implement io.ReaderAt, only the
+// chunks that are read are decrypted. Their size is computed from the size
+// of the encrypted file.
+type FS struct {
+	fsys       fs.FS
+	identities []Identity
+}
+
+var _ fs.FS = &FS{}
+
+// NewFS returns an FS that decrypts the ".age" files of fsys with identities.
+func NewFS(fsys fs.FS, identities ...Identity) *FS {
+	return &FS{fsys: fsys, identities: identities}
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name != "." {
+		f, err := fsys.openEncrypted(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	f, err := fsys.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		if d, ok := f.(fs.ReadDirFile); ok {
+			return &dir{ReadDirFile: d, fsys: fsys, name: name}, nil
+		}
+		return f, nil
+	}
+	if strings.HasSuffix(name, ".age") {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f, nil
+}
+
+// openEncrypted opens and decrypts name + ".age", and returns an error
+// wrapping fs.ErrNotExist if it doesn't exist or is not a regular file.
+func (fsys *FS) openEncrypted(name string) (fs.File, error) {
+	f, err := fsys.fsys.Open(name + ".age")
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	r, err := fsys.decrypt(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{
+		SectionReader: io.NewSectionReader(r, 0, r.Size()),
+		f:             f,
+		info:          &fileInfo{FileInfo: info, name: path.Base(name), size: r.Size()},
+	}, nil
+}
+
+// sizeReaderAt is implemented by bytes.Reader and stream.ReaderAt.
+type sizeReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+func (fsys *FS) decrypt(f fs.File, size int64) (sizeReaderAt, error) {
+	var src io.Reader = f
+	if ra, ok := f.(io.ReaderAt); ok {
+		hdrLen, err := headerLength(io.NewSectionReader(ra, 0, size))
+		if err == nil {
+			r, err := fsys.decryptAt(ra, hdrLen, size)
+			if err != errNoRandomAccess {
+				return r, err
+			}
+		} else if err != errArmored {
+			return nil, err
+		}
+		src = io.NewSectionReader(ra, 0, size)
+	}
+
+	// Armored files and files with payload extensions don't allow random
+	// access, and neither does f, so decrypt the whole file in memory.
+	r, err := Decrypt(src, fsys.identities...)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(contents), nil
+}
+
+func (fsys *FS) decryptAt(ra io.ReaderAt, hdrLen, size int64) (sizeReaderAt, error) {
+	payloadOffset := hdrLen + 16
+	h, err := ParseHeader(io.NewSectionReader(ra, 0, payloadOffset))
+	if err != nil {
+		return nil, err
+	}
+	if len(h.extensions) > 0 {
+		return nil, errNoRandomAccess
+	}
+	fileKey, err := h.Unwrap(fsys.identities...)
+	if err != nil {
+		return nil, err
+	}
+	payloadKey, err := h.payloadKey(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	payload := io.NewSectionReader(ra, payloadOffset, size-payloadOffset)
+	return stream.NewReaderAtWithCipher(h.payloadCipher, payloadKey, payload, payload.Size())
+}
+
+// plaintextSize returns the size of the decrypted file name + ".age", without
+// decrypting it if possible.
+func (fsys *FS) plaintextSize(name string) (int64, error) {
+	f, err := fsys.fsys.Open(name + ".age")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if ra, ok := f.(io.ReaderAt); ok {
+		hdrLen, err := headerLength(io.NewSectionReader(ra, 0, info.Size()))
+		if err != nil && err != errArmored {
+			return 0, err
+		}
+		if err == nil {
+			h, err := ParseHeader(io.NewSectionReader(ra, 0, hdrLen))
+			if err != nil {
+				return 0, err
+			}
+			if len(h.extensions) == 0 {
+				return stream.PlaintextSize(info.Size() - hdrLen - 16)
+			}
+		}
+	}
+	df, err := fsys.openEncrypted(name)
+	if err != nil {
+		return 0, err
+	}
+	defer df.Close()
+	dinfo, err := df.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return dinfo.Size(), nil
+}
+
+var (
+	errArmored        = errors.New("armored file")
+	errNoRandomAccess = errors.New("payload extensions don't allow random access")
+)
+
+// headerLength returns the length of the header of a binary file, up to and
+// including the MAC line, which is the only one that starts with "---".
+func headerLength(src io.Reader) (int64, error) {
+	r := bufio.NewReader(src)
+	if start, _ := r.Peek(len("-----BEGIN")); string(start) == "-----BEGIN" {
+		return 0, errArmored
+	}
+	var n int64
+	lineStart := true
+	for n < maxHeaderSize {
+		line, err := r.ReadSlice('\n')
+		n += int64(len(line))
+		isFooter := lineStart && bytes.HasPrefix(line, []byte("---"))
+		lineStart = err == nil
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read header: %v", err)
+		}
+		if isFooter {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to read header: longer than %d bytes", maxHeaderSize)
+}
+
+type file struct {
+	*io.SectionReader
+	f    fs.File
+	info fs.FileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Close() error               { return f.f.Close() }
+
+type fileInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (i *fileInfo) Name() string { return i.name }
+func (i *fileInfo) Size() int64  { return i.size }
+
+// dir lists the encrypted files under their decrypted names.
+type dir struct {
+	fs.ReadDirFile
+	fsys *FS
+	name string
+
+	entries []fs.DirEntry // not yet returned by ReadDir
+	listed  bool
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.ReadDirFile.ReadDir(-1)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = d.fsys.decryptedEntries(d.name, entries)
+		d.listed = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (fsys *FS) decryptedEntries(dirName string, entries []fs.DirEntry) []fs.DirEntry {
+	encrypted := make(map[string]bool)
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), ".age") {
+			encrypted[strings.TrimSuffix(e.Name(), ".age")] = true
+		}
+	}
+	var out []fs.DirEntry
+	for _, e := range entries {
+		switch {
+		case encrypted[e.Name()]:
+			// Shadowed by an encrypted file.
+		case e.Type().IsRegular() && strings.HasSuffix(e.Name(), ".age"):
+			name := strings.TrimSuffix(e.Name(), ".age")
+			out = append(out, &dirEntry{DirEntry: e, fsys: fsys,
+				name: name, path: path.Join(dirName, name)})
+		default:
+			out = append(out, e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out
+}
+
+type dirEntry struct {
+	fs.DirEntry
+	fsys *FS
+	name string
+	path string
+}
+
+func (e *dirEntry) Name() string { return e.name }
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	size, err := e.fsys.plaintextSize(e.path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: e.path, Err: err}
+	}
+	return &fileInfo{FileInfo: info, name: e.name, size: size}, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"filippo.io/age/internal/age"
+)
+
+func TestFS(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := make([]byte, 3*64*1024+100)
+	if _, err := rand.Read(large); err != nil {
+		t.Fatal(err)
+	}
+	encrypt := func(plaintext []byte, armor bool) []byte {
+		buf := &bytes.Buffer{}
+		w, err := age.EncryptWithOptions(buf, &age.EncryptOptions{Armor: armor}, i.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	fsys := age.NewFS(fstest.MapFS{
+		"plain.txt":         {Data: []byte("plain")},
+		"secret.txt.age":    {Data: encrypt([]byte(helloWorld), false)},
+		"secret.txt":        {Data: []byte("shadowed")},
+		"dir/large.bin.age": {Data: encrypt(large, false)},
+		"dir/armored.age":   {Data: encrypt([]byte(helloWorld), true)},
+		"dir/empty.age":     {Data: encrypt(nil, false)},
+	}, i)
+	if err := fstest.TestFS(fsys, "plain.txt", "secret.txt", "dir/large.bin", "dir/armored", "dir/empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := fs.ReadFile(fsys, "secret.txt"); err != nil || string(b) != helloWorld {
+		t.Errorf("secret.txt is %q, %v", b, err)
+	}
+	if b, err := fs.ReadFile(fsys, "dir/armored"); err != nil || string(b) != helloWorld {
+		t.Errorf("dir/armored is %q, %v", b, err)
+	}
+	if _, err := fsys.Open("secret.txt.age"); err == nil {
+		t.Error("the encrypted file is visible")
+	}
+
+	f, err := fsys.Open("dir/large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() != int64(len(large)) {
+		t.Errorf("Stat returned %v, %v; expected size %d", info, err, len(large))
+	}
+	buf := make([]byte, 1000)
+	off := int64(2*64*1024 - 500)
+	if _, err := f.(io.ReaderAt).ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, large[off:off+1000]) {
+		t.Error("ReadAt across a chunk boundary returned the wrong data")
+	}
+}
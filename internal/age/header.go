@@ -0,0 +1,260 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age/internal/format"
+	"filippo.io/age/internal/stream"
+)
+
+var (
+	// ErrNoIdentityMatch is returned when none of the identities passed to
+	// Decrypt can unwrap any of the recipient stanzas of the file.
+	ErrNoIdentityMatch = errors.New("no identity matched a recipient")
+
+	// ErrBadHeaderMAC is returned when the header fails to authenticate with
+	// the unwrapped file key, because it was tampered with.
+	ErrBadHeaderMAC = errors.New("bad header MAC")
+
+	// ErrTruncated is returned when reading a payload that ends at a chunk
+	// boundary, without a chunk marked as the last one.
+	ErrTruncated = stream.ErrTruncated
+
+	// ErrTrailingData is returned when reading a payload that continues after
+	// its last chunk.
+	ErrTrailingData = stream.ErrTrailingData
+)
+
+// ErrChunkAuthentication is returned when reading a payload chunk that fails
+// to authenticate, because it was tampered with or because the file was
+// truncated within it. Its Offset is relative to the start of the payload,
+// after the header and the 16-byte nonce, while Header.Position reports the
+// offset in the file.
+type ErrChunkAuthentication = stream.ErrChunkAuthentication
+
+// A Header is the parsed header of a file, followed by the still unread
+// payload. It allows looking at the recipient stanzas before deciding which
+// identities to use, for example to fetch only the keys that could match.
+//
+// Decrypt, or Unwrap and then Open, continue reading the payload from where
+// ParseHeader left off, and can be called only once.
+type Header struct {
+	hdr           *format.Header
+	payload       io.Reader
+	payloadCipher stream.Cipher
+
+	// extensions are the payload extensions listed in the payload stanza.
+	extensions []string
+	// metadata is set by Open if the payload has a metadata record.
+	metadata *Metadata
+	// maxDecompressedSize is set by Unwrap from DecryptOptions.
+	maxDecompressedSize int64
+
+	// size is the length of the encoded header, without armor.
+	size int64
+	// stream is set by Open.
+	stream *stream.Reader
+}
+
+// ParseHeader reads and validates the header of a file from src, which can
+// be armored, leaving the payload unread.
+func ParseHeader(src io.Reader) (*Header, error) {
+	hdr, payload, err := format.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	exts, recipients, err := parsePayloadStanza(hdr.Recipients)
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) > 20 {
+		return nil, errors.New("too many recipients")
+	}
+	payloadCipher, ok := payloadCiphers[hdr.Version]
+	if !ok {
+		return nil, fmt.Errorf("unsupported format version %q", hdr.Version)
+	}
+	for _, r := range recipients {
+		if r.Type == "scrypt" && len(hdr.Recipients) != 1 {
+			return nil, errors.New("an scrypt recipient must be the only one")
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := hdr.Marshal(buf); err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	return &Header{hdr: hdr, payload: payload, payloadCipher: payloadCipher,
+		extensions: exts, size: int64(buf.Len())}, nil
+}
+
+// Stanzas returns the recipient stanzas of the file. They must not be
+// modified.
+func (h *Header) Stanzas() []*format.Recipient {
+	return h.hdr.Recipients
+}
+
+// Decrypt is like the package-level Decrypt, but continues from the parsed
+// header. It's equivalent to Unwrap followed by Open.
+func (h *Header) Decrypt(identities ...Identity) (io.Reader, error) {
+	fileKey, err := h.Unwrap(identities...)
+	if err != nil {
+		return nil, err
+	}
+	return h.Open(fileKey)
+}
+
+// Unwrap returns the file key, trying each identity against the stanzas like
+// Decrypt, and checks it against the header MAC.
+//
+// The file key can decrypt only this file, so it can be handed to a third
+// party to grant access to it without sharing the identities.
+func (h *Header) Unwrap(identities ...Identity) (fileKey []byte, err error) {
+	fileKey, _, err = h.UnwrapWithOptions(nil, identities...)
+	return fileKey, err
+}
+
+// UnwrapWithOptions is like Unwrap, but takes the same options as
+// DecryptWithOptions and reports the same result as DecryptWithResult.
+func (h *Header) UnwrapWithOptions(opts *DecryptOptions, identities ...Identity) ([]byte, *DecryptResult, error) {
+	fileKey, res, err := h.unwrap(context.Background(), opts, identities)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := h.checkMAC(fileKey); err != nil {
+		return nil, nil, err
+	}
+	return fileKey, res, nil
+}
+
+func (h *Header) unwrap(ctx context.Context, opts *DecryptOptions, identities []Identity) ([]byte, *DecryptResult, error) {
+	if opts == nil {
+		opts = &DecryptOptions{}
+	}
+	if len(identities) == 0 {
+		return nil, nil, errors.New("no identities specified")
+	}
+	h.maxDecompressedSize = opts.MaxDecompressedSize
+
+	var fileKey []byte
+	var err error
+	res := &DecryptResult{Header: h.hdr}
+	for _, i := range identities {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		fileKey, res.StanzaIndex, err = unwrap(ctx, i, h.hdr.Recipients, opts.Prompter)
+		if err != nil {
+			if err == ErrIncorrectIdentity {
+				// TODO: we should collect these errors and return them as an
+				// []error type with an Error method. That will require turning
+				// ErrIncorrectIdentity into an interface or wrapper error.
+				continue
+			}
+			return nil, nil, err
+		}
+		res.Identity = i
+		break
+	}
+	if fileKey == nil {
+		return nil, nil, ErrNoIdentityMatch
+	}
+	if res.StanzaIndex >= 0 {
+		res.StanzaType = h.hdr.Recipients[res.StanzaIndex].Type
+	} else {
+		res.StanzaType = res.Identity.Type()
+	}
+	return fileKey, res, nil
+}
+
+// Open checks fileKey against the header MAC and returns a Reader for the
+// decrypted payload.
+func (h *Header) Open(fileKey []byte) (io.Reader, error) {
+	payloadKey, err := h.payloadKey(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	r, err := stream.NewReaderWithCipher(h.payloadCipher, payloadKey, h.payload)
+	if err != nil {
+		return nil, err
+	}
+	h.stream = r
+	return h.wrapPayloadReader(r)
+}
+
+// OpenWithOptions is like Open, but applies opts.MaxDecompressedSize. The
+// other options only affect unwrapping, and are ignored.
+func (h *Header) OpenWithOptions(fileKey []byte, opts *DecryptOptions) (io.Reader, error) {
+	if opts != nil {
+		h.maxDecompressedSize = opts.MaxDecompressedSize
+	}
+	return h.Open(fileKey)
+}
+
+// Position returns the index of the next payload chunk to be authenticated,
+// and its offset in the file. If reading from the Reader returned by Open
+// failed, it's the chunk that was damaged or missing, and all the data read
+// up to that point was authenticated.
+//
+// For armored files, offset is relative to the decoded binary file.
+// Position must be called after Open.
+func (h *Header) Position() (chunk, offset int64) {
+	if h.stream == nil {
+		panic("age: Position called before Open")
+	}
+	chunk, offset = h.stream.Position()
+	return chunk, h.size + 16 + offset
+}
+
+// Metadata returns the metadata record of the file, stored with
+// EncryptOptions.Metadata. It returns nil until Open or Decrypt are called,
+// and if the file doesn't have a metadata record.
+func (h *Header) Metadata() *Metadata {
+	return h.metadata
+}
+
+// payloadKey checks fileKey against the header MAC, reads the nonce, and
+// derives the payload key.
+func (h *Header) payloadKey(fileKey []byte) ([]byte, error) {
+	if err := h.checkMAC(fileKey); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(h.payload, nonce); err != nil {
+		return nil, fmt.Errorf("failed to read nonce: %v", err)
+	}
+	return streamKey(fileKey, nonce), nil
+}
+
+func (h *Header) checkMAC(fileKey []byte) error {
+	if len(fileKey) != 16 {
+		return errors.New("invalid file key size")
+	}
+	if mac, err := headerMAC(fileKey, h.hdr); err != nil {
+		return fmt.Errorf("failed to compute header MAC: %v", err)
+	} else if !hmac.Equal(mac, h.hdr.MAC) {
+		return ErrBadHeaderMAC
+	}
+	return nil
+}
+
+// DecryptWithFileKey decrypts a file with its file key, as returned by
+// Header.Unwrap, instead of an identity.
+func DecryptWithFileKey(src io.Reader, fileKey []byte) (io.Reader, error) {
+	h, err := ParseHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	return h.Open(fileKey)
+}
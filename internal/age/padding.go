@@ -0,0 +1,186 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+
+	"filippo.io/age/internal/stream"
+)
+
+// Padme returns the padded size of a payload of the given size according to
+// the Padmé scheme, which leaks at most O(log log size) bits of information
+// about the size, with an overhead of at most 12%. It can be used as
+// EncryptOptions.Pad.
+//
+// See "Reducing Metadata Leakage from Encrypted Files and Communication with
+// PURBs", by Nikitin et al.
+func Padme(size int64) int64 {
+	if size < 0 {
+		return size
+	}
+	e := bits.Len64(uint64(size)) - 1
+	s := bits.Len64(uint64(e))
+	if e < s {
+		return size
+	}
+	mask := int64(1)<<uint(e-s) - 1
+	return (size + mask) &^ mask
+}
+
+// PadToMultiple returns a function, to be used as EncryptOptions.Pad, that
+// pads payloads to a multiple of m bytes, so that all payloads shorter than m
+// have the same size. If the padded size would overflow an int64, the
+// function returns -1, which makes the Writer fail on Close.
+func PadToMultiple(m int64) func(size int64) int64 {
+	if m <= 0 {
+		panic("age: PadToMultiple called with a non-positive size")
+	}
+	return func(size int64) int64 {
+		n := size / m
+		if size%m != 0 {
+			n++
+		}
+		if n > math.MaxInt64/m {
+			return -1
+		}
+		return n * m
+	}
+}
+
+// The padding is a 0x80 byte followed by zeroes, appended to the payload
+// before encryption. It can't be stripped undetected, since the last STREAM
+// chunk is authenticated as such.
+const padMarker = 0x80
+
+// padWriter appends the padding on Close.
+type padWriter struct {
+	w   io.WriteCloser
+	pad func(int64) int64
+	n   int64
+}
+
+func (w *padWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *padWriter) Close() error {
+	if _, err := w.w.Write([]byte{padMarker}); err != nil {
+		return err
+	}
+	w.n++
+	target := w.pad(w.n)
+	if target < w.n {
+		return fmt.Errorf("invalid padded size %d for a %d bytes payload", target, w.n)
+	}
+	zeroes := make([]byte, stream.ChunkSize)
+	for w.n < target {
+		chunk := zeroes
+		if int64(len(chunk)) > target-w.n {
+			chunk = chunk[:target-w.n]
+		}
+		if _, err := w.w.Write(chunk); err != nil {
+			return err
+		}
+		w.n += int64(len(chunk))
+	}
+	return w.w.Close()
+}
+
+var errMalformedPadding = errors.New("malformed padding")
+
+// unpadReader removes the padding from the end of src. It holds back any
+// trailing 0x80 byte followed by zeroes, without buffering them, until it
+// knows whether they are padding or data.
+type unpadReader struct {
+	src io.Reader
+	buf []byte
+
+	out    []byte // data ready to be returned, after marker and zeroes
+	marker bool   // a held 0x80 byte that turned out to be data
+	zeroes int64  // held zeroes that turned out to be data
+
+	held       bool  // a 0x80 byte followed by heldZeroes zeroes is held back
+	heldZeroes int64 // zeroes following the held 0x80 byte
+
+	err error
+}
+
+func (r *unpadReader) Read(p []byte) (int, error) {
+	if r.buf == nil {
+		r.buf = make([]byte, stream.ChunkSize)
+	}
+	for {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		if r.marker {
+			p[0] = padMarker
+			r.marker = false
+			return 1, nil
+		}
+		if r.zeroes > 0 {
+			n := len(p)
+			if int64(n) > r.zeroes {
+				n = int(r.zeroes)
+			}
+			for i := range p[:n] {
+				p[i] = 0
+			}
+			r.zeroes -= int64(n)
+			return n, nil
+		}
+		if len(r.out) > 0 {
+			n := copy(p, r.out)
+			r.out = r.out[n:]
+			return n, nil
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		n, err := r.src.Read(r.buf)
+		data := r.buf[:n]
+		last := len(data) - 1
+		for last >= 0 && data[last] == 0 {
+			last--
+		}
+		switch {
+		case last < 0 && r.held:
+			r.heldZeroes += int64(n)
+		case last < 0:
+			r.out = data
+		default:
+			// The held bytes, if any, are followed by data.
+			if r.held {
+				r.marker, r.zeroes = true, r.heldZeroes
+				r.held = false
+			}
+			if data[last] == padMarker {
+				r.out = data[:last]
+				r.held, r.heldZeroes = true, int64(n-last-1)
+			} else {
+				r.out = data
+			}
+		}
+
+		if err == io.EOF && !r.held {
+			err = errMalformedPadding
+		}
+		if err != nil {
+			// On io.EOF, the held bytes are the padding, and are dropped.
+			r.held = false
+			r.err = err
+		}
+	}
+}
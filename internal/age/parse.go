@@ -0,0 +1,216 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A RecipientParser parses the string encoding of a recipient, such as
+// "age1..." or "ssh-ed25519 AAAA...".
+type RecipientParser func(s string) (Recipient, error)
+
+// An IdentityParser parses the string encoding of an identity. That is either
+// a single line of an identities file, such as "AGE-SECRET-KEY-1...", or a
+// whole PEM block, from the "-----BEGIN" line to the "-----END" line included.
+type IdentityParser func(s string) (Identity, error)
+
+var (
+	parsersMu        sync.RWMutex
+	recipientParsers = make(map[string]RecipientParser)
+	identityParsers  = make(map[string]IdentityParser)
+)
+
+// RegisterRecipientParser makes ParseRecipient and ParseRecipients use fn for
+// strings that start with prefix, replacing any parser previously registered
+// for the same prefix. If more than one prefix matches, the longest one wins.
+//
+// It's meant to be called from the init function of a package implementing a
+// Recipient, so that programs can add recipient types by importing it.
+func RegisterRecipientParser(prefix string, fn RecipientParser) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+	recipientParsers[prefix] = fn
+}
+
+// RegisterIdentityParser makes ParseIdentities use fn for identities that
+// start with prefix, replacing any parser previously registered for the same
+// prefix. If more than one prefix matches, the longest one wins. Parsers for
+// PEM blocks are registered with prefixes like "-----BEGIN".
+//
+// It's meant to be called from the init function of a package implementing an
+// Identity, so that programs can add identity types by importing it.
+func RegisterIdentityParser(prefix string, fn IdentityParser) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+	identityParsers[prefix] = fn
+}
+
+func init() {
+	RegisterRecipientParser("age1", func(s string) (Recipient, error) {
+		return ParseX25519Recipient(s)
+	})
+	RegisterRecipientParser("ssh-", ParseSSHRecipient)
+	RegisterIdentityParser("AGE-SECRET-KEY-1", func(s string) (Identity, error) {
+		return ParseX25519Identity(s)
+	})
+	RegisterIdentityParser("-----BEGIN", parseSSHIdentityBlock)
+}
+
+// parseSSHIdentityBlock parses a PEM encoded SSH private key. If the key is
+// passphrase protected, it returns an EncryptedSSHIdentity, or the
+// *ssh.PassphraseMissingError if the public key is not embedded in the file.
+func parseSSHIdentityBlock(s string) (Identity, error) {
+	pemBytes := []byte(s)
+	id, err := ParseSSHIdentity(pemBytes)
+	if sshErr, ok := err.(*ssh.PassphraseMissingError); ok {
+		if sshErr.PublicKey == nil {
+			return nil, sshErr
+		}
+		return NewEncryptedSSHIdentity(sshErr.PublicKey, pemBytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed SSH identity: %v", err)
+	}
+	return id, nil
+}
+
+// longestPrefix returns the longest of prefixes that s starts with.
+func longestPrefix(s string, prefixes []string) (string, bool) {
+	var match string
+	var found bool
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) && len(p) >= len(match) {
+			match, found = p, true
+		}
+	}
+	return match, found
+}
+
+// ParseRecipient parses a recipient string with the registered parsers.
+func ParseRecipient(s string) (Recipient, error) {
+	parsersMu.RLock()
+	prefixes := make([]string, 0, len(recipientParsers))
+	for p := range recipientParsers {
+		prefixes = append(prefixes, p)
+	}
+	p, ok := longestPrefix(s, prefixes)
+	fn := recipientParsers[p]
+	parsersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown recipient type: %q", s)
+	}
+	return fn(s)
+}
+
+// A ParseError is returned by ParseRecipients and ParseIdentities, and points
+// to the line, or the first line of the PEM block, that failed to parse.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ParseRecipients parses a list of recipients, one per line, ignoring empty
+// lines and lines starting with "#".
+func ParseRecipients(f io.Reader) ([]Recipient, error) {
+	var recs []Recipient
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		r, err := ParseRecipient(line)
+		if err != nil {
+			return nil, &ParseError{Line: n, Err: err}
+		}
+		recs = append(recs, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recipients: %v", err)
+	}
+	return recs, nil
+}
+
+// ParseIdentities parses an identities file, which can mix identities encoded
+// as single lines with any number of PEM blocks, ignoring empty lines and
+// lines starting with "#" outside of PEM blocks.
+func ParseIdentities(f io.Reader) ([]Identity, error) {
+	var ids []Identity
+	var block strings.Builder
+	var blockLine int
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if blockLine != 0 {
+			block.WriteString(line + "\n")
+			if !strings.HasPrefix(line, "-----END") {
+				continue
+			}
+			i, err := parseIdentity(block.String())
+			if err != nil {
+				return nil, &ParseError{Line: blockLine, Err: err}
+			}
+			ids = append(ids, i)
+			block.Reset()
+			blockLine = 0
+			continue
+		}
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "-----BEGIN") {
+			block.WriteString(line + "\n")
+			blockLine = n
+			continue
+		}
+		i, err := parseIdentity(line)
+		if err != nil {
+			return nil, &ParseError{Line: n, Err: err}
+		}
+		ids = append(ids, i)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read identities: %v", err)
+	}
+	if blockLine != 0 {
+		return nil, &ParseError{Line: blockLine, Err: fmt.Errorf("PEM block is not terminated")}
+	}
+	return ids, nil
+}
+
+func parseIdentity(s string) (Identity, error) {
+	parsersMu.RLock()
+	prefixes := make([]string, 0, len(identityParsers))
+	for p := range identityParsers {
+		prefixes = append(prefixes, p)
+	}
+	p, ok := longestPrefix(s, prefixes)
+	fn := identityParsers[p]
+	parsersMu.RUnlock()
+
+	if !ok {
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			s = s[:i]
+		}
+		return nil, fmt.Errorf("unknown identity type: %q", s)
+	}
+	return fn(s)
+}
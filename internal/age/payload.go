@@ -0,0 +1,323 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"filippo.io/age/internal/format"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// payloadStanzaType is the type of the stanza that lists, as its arguments,
+// the extensions applied to the plaintext before encrypting it, such as a
+// metadata record. Being part of the header, it's authenticated by the header
+// MAC, so the extensions can't be added or stripped undetected.
+//
+// Implementations that don't know it ignore it like any other unknown stanza,
+// and return the payload with the extensions still applied. That doesn't hold
+// for scrypt, whose stanza must be the only one, so extensions can't be used
+// with passphrases. Files without extensions don't have the stanza.
+const payloadStanzaType = "x-payload"
+
+const (
+	extMetadata = "metadata"
+	extGzip     = "gzip"
+	extZstd     = "zstd"
+	extPad      = "pad"
+)
+
+// supportedExtensions lists the extensions that Open knows how to remove.
+var supportedExtensions = map[string]bool{
+	extMetadata: true,
+	extGzip:     true,
+	extZstd:     true,
+	extPad:      true,
+}
+
+// payloadExtensions returns the extensions selected by opts.
+func (opts *EncryptOptions) payloadExtensions() []string {
+	var exts []string
+	if opts.Metadata != nil {
+		exts = append(exts, extMetadata)
+	}
+	if opts.Compress != "" {
+		exts = append(exts, opts.Compress)
+	}
+	if opts.Pad != nil {
+		exts = append(exts, extPad)
+	}
+	return exts
+}
+
+// parsePayloadStanza returns the extensions listed by the payload stanza, if
+// any, and the recipient stanzas without it.
+func parsePayloadStanza(stanzas []*format.Recipient) (exts []string, recipients []*format.Recipient, err error) {
+	var found bool
+	for _, s := range stanzas {
+		if s.Type != payloadStanzaType {
+			recipients = append(recipients, s)
+			continue
+		}
+		if found {
+			return nil, nil, errors.New("duplicate payload stanza")
+		}
+		found = true
+		seen := make(map[string]bool)
+		for _, e := range s.Args {
+			if !supportedExtensions[e] {
+				return nil, nil, fmt.Errorf("unsupported payload extension %q", e)
+			}
+			if seen[e] {
+				return nil, nil, fmt.Errorf("duplicate payload extension %q", e)
+			}
+			seen[e] = true
+		}
+		exts = s.Args
+	}
+	if hasExtension(exts, extGzip) && hasExtension(exts, extZstd) {
+		return nil, nil, errors.New("conflicting payload extensions")
+	}
+	return exts, recipients, nil
+}
+
+func hasExtension(exts []string, e string) bool {
+	for _, ee := range exts {
+		if ee == e {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapPayloadWriter applies the extensions selected by opts to the plaintext
+// written to the returned Writer, before passing it to w.
+func wrapPayloadWriter(w io.WriteCloser, opts *EncryptOptions) (io.WriteCloser, error) {
+	if opts.Pad != nil {
+		w = &padWriter{w: w, pad: opts.Pad}
+	}
+	if opts.Metadata != nil {
+		if err := writeMetadata(w, opts.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	switch opts.Compress {
+	case extGzip:
+		return &compressWriter{WriteCloser: gzip.NewWriter(w), dst: w}, nil
+	case extZstd:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &compressWriter{WriteCloser: zw, dst: w}, nil
+	}
+	return w, nil
+}
+
+// wrapPayloadReader removes the extensions of h from the plaintext read from
+// r, and stores the metadata record in h, if present.
+func (h *Header) wrapPayloadReader(r io.Reader) (io.Reader, error) {
+	if hasExtension(h.extensions, extPad) {
+		r = &unpadReader{src: r}
+	}
+	if hasExtension(h.extensions, extMetadata) {
+		br := bufio.NewReaderSize(r, maxMetadataSize)
+		m, err := readMetadata(br)
+		if err != nil {
+			return nil, err
+		}
+		h.metadata = m
+		r = br
+	}
+	if hasExtension(h.extensions, extGzip) || hasExtension(h.extensions, extZstd) {
+		compressed := &countingReader{r: r}
+		var d io.Reader
+		if hasExtension(h.extensions, extGzip) {
+			zr, err := gzip.NewReader(compressed)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress payload: %w", err)
+			}
+			d = zr
+		} else {
+			zr, err := zstd.NewReader(compressed, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress payload: %w", err)
+			}
+			d = &zstdReader{zr}
+		}
+		r = &decompressReader{r: d, compressed: compressed, max: h.maxDecompressedSize}
+	}
+	return r, nil
+}
+
+// compressWriter closes the compressor and then the underlying Writer.
+type compressWriter struct {
+	io.WriteCloser
+	dst io.WriteCloser
+}
+
+func (w *compressWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.dst.Close()
+}
+
+// zstdReader releases the decoder resources once the end of the input is
+// reached or an error occurs.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	n, err := r.Decoder.Read(p)
+	if err != nil {
+		r.Decoder.Close()
+	}
+	return n, err
+}
+
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error // the last error from r, other than io.EOF
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// ErrDecompressionLimit is returned when reading a compressed payload that
+// decompresses to more than DecryptOptions.MaxDecompressedSize.
+var ErrDecompressionLimit = errors.New("decompressed payload exceeds the size limit")
+
+// maxCompressionRatio and minDecompressionLimit bound the size of compressed
+// payloads if DecryptOptions.MaxDecompressedSize is zero. Regular data
+// rarely compresses better than 1:100. DEFLATE can't do better than about
+// 1:1000, so a gzip bomb is only stopped by a ratio well below that.
+const (
+	maxCompressionRatio   = 100
+	minDecompressionLimit = 1 << 20
+)
+
+type decompressReader struct {
+	r          io.Reader
+	compressed *countingReader
+	n          int64 // decompressed bytes so far
+	max        int64
+	err        error
+}
+
+func (r *decompressReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	limit := r.max
+	if limit == 0 {
+		limit = r.compressed.n*maxCompressionRatio + minDecompressionLimit
+	}
+	if limit > 0 && r.n > limit {
+		r.err = ErrDecompressionLimit
+		return 0, r.err
+	}
+	switch {
+	case err == nil || err == io.EOF:
+	case r.compressed.err != nil:
+		// Errors from the payload, like a damaged chunk, are not
+		// decompression errors, and the decompressor might have wrapped them.
+		err = r.compressed.err
+	default:
+		err = fmt.Errorf("failed to decompress payload: %w", err)
+	}
+	r.err = err
+	return n, err
+}
+
+// Metadata describes the original file. It can be stored with
+// EncryptOptions.Metadata, and is encrypted and authenticated along with the
+// rest of the payload.
+type Metadata struct {
+	// Name is the name of the original file. When decrypting, it must be
+	// validated before being used as a path, as it might contain path
+	// separators.
+	Name string
+
+	// Mode is the file mode of the original file, or zero if unknown.
+	Mode fs.FileMode
+
+	// ModTime is the modification time of the original file, or the zero
+	// Time if unknown.
+	ModTime time.Time
+
+	// ContentType is the MIME type of the contents, or empty if unknown.
+	ContentType string
+}
+
+// maxMetadataSize is the maximum size of the encoded metadata record.
+const maxMetadataSize = 4096
+
+// metadataRecord is the encoding of Metadata, a JSON object on a single line
+// at the start of the plaintext.
+type metadataRecord struct {
+	Name        string `json:"name,omitempty"`
+	Mode        uint32 `json:"mode,omitempty"`
+	ModTime     string `json:"mtime,omitempty"`
+	ContentType string `json:"type,omitempty"`
+}
+
+func writeMetadata(w io.Writer, m *Metadata) error {
+	rec := &metadataRecord{Name: m.Name, Mode: uint32(m.Mode), ContentType: m.ContentType}
+	if !m.ModTime.IsZero() {
+		rec.ModTime = m.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	line = append(line, '\n')
+	if len(line) > maxMetadataSize {
+		return errors.New("failed to encode metadata: record too long")
+	}
+	_, err = w.Write(line)
+	return err
+}
+
+func readMetadata(r *bufio.Reader) (*Metadata, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errors.New("malformed metadata: record too long")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	var rec metadataRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return nil, fmt.Errorf("malformed metadata: %v", err)
+	}
+	m := &Metadata{Name: rec.Name, Mode: fs.FileMode(rec.Mode), ContentType: rec.ContentType}
+	if rec.ModTime != "" {
+		m.ModTime, err = time.Parse(time.RFC3339Nano, rec.ModTime)
+		if err != nil {
+			return nil, fmt.Errorf("malformed metadata: %v", err)
+		}
+	}
+	return m, nil
+}
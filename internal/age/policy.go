@@ -0,0 +1,101 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A Policy restricts the recipients a file can be encrypted to, and lists
+// escrow recipients that must always be added.
+type Policy struct {
+	// AllowedTypes lists the allowed recipient types, as returned by
+	// Recipient.Type. If empty, all types are allowed.
+	AllowedTypes []string
+
+	// MinRSABits is the minimum modulus size for SSHRSARecipient keys.
+	MinRSABits int
+
+	// Revoked lists recipients that must be rejected, either as "age1..."
+	// strings or as SSH key fingerprints in the "SHA256:..." format.
+	Revoked []string
+
+	// Escrow recipients are added to every set of recipients by Apply.
+	Escrow []Recipient
+}
+
+// Check returns an error if the recipient is not allowed by the policy.
+func (p *Policy) Check(r Recipient) error {
+	if len(p.AllowedTypes) > 0 {
+		var allowed bool
+		for _, t := range p.AllowedTypes {
+			if r.Type() == t {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("recipient %s rejected by policy: type %q is not allowed", recipientName(r), r.Type())
+		}
+	}
+
+	if r, ok := r.(*SSHRSARecipient); ok && p.MinRSABits > 0 {
+		if bits := r.pubKey.N.BitLen(); bits < p.MinRSABits {
+			return fmt.Errorf("recipient %s rejected by policy: %d-bit RSA key is smaller than the minimum of %d bits", recipientName(r), bits, p.MinRSABits)
+		}
+	}
+
+	for _, id := range recipientIDs(r) {
+		for _, revoked := range p.Revoked {
+			if id == revoked {
+				return fmt.Errorf("recipient %s rejected by policy: key is revoked", recipientName(r))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Apply checks every recipient, including the escrow ones, against the policy
+// and returns the recipients with the escrow recipients appended.
+func (p *Policy) Apply(recipients []Recipient) ([]Recipient, error) {
+	all := make([]Recipient, 0, len(recipients)+len(p.Escrow))
+	all = append(all, recipients...)
+	all = append(all, p.Escrow...)
+	for _, r := range all {
+		if err := p.Check(r); err != nil {
+			return nil, err
+		}
+	}
+	return all, nil
+}
+
+// recipientIDs returns the strings a Policy can use to refer to r.
+func recipientIDs(r Recipient) []string {
+	switch r := r.(type) {
+	case *X25519Recipient:
+		return []string{r.String()}
+	case *SSHRSARecipient:
+		return []string{ssh.FingerprintSHA256(r.sshKey)}
+	case *SSHEd25519Recipient:
+		return []string{ssh.FingerprintSHA256(r.sshKey)}
+	}
+	return nil
+}
+
+// recipientName returns a human readable name for r, for error messages.
+func recipientName(r Recipient) string {
+	if ids := recipientIDs(r); len(ids) > 0 {
+		return ids[0]
+	}
+	if r, ok := r.(fmt.Stringer); ok {
+		return r.String()
+	}
+	return fmt.Sprintf("of type %q", r.Type())
+}
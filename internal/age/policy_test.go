@@ -0,0 +1,95 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"filippo.io/age/internal/age"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPolicy(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519 := id.Recipient()
+
+	escrowID, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	escrow := escrowID.Recipient()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshRSA, err := age.NewSSHRSARecipient(rsaPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSSHPub, err := ssh.NewPublicKey(edPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshEd25519, err := age.NewSSHEd25519Recipient(edSSHPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scrypt, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &age.Policy{
+		AllowedTypes: []string{"X25519", "ssh-rsa", "ssh-ed25519"},
+		MinRSABits:   2048,
+		Revoked:      []string{ssh.FingerprintSHA256(edSSHPub)},
+		Escrow:       []age.Recipient{escrow},
+	}
+
+	if err := p.Check(x25519); err != nil {
+		t.Errorf("X25519 recipient rejected: %v", err)
+	}
+	if err := p.Check(scrypt); err == nil {
+		t.Error("scrypt recipient accepted despite not being allowed")
+	}
+	if err := p.Check(sshRSA); err == nil {
+		t.Error("1024-bit RSA recipient accepted")
+	}
+	if err := p.Check(sshEd25519); err == nil {
+		t.Error("revoked SSH recipient accepted")
+	}
+
+	rs, err := p.Apply([]age.Recipient{x25519})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 2 || rs[0] != x25519 || rs[1] != escrow {
+		t.Errorf("Apply returned %v, expected the recipient and the escrow recipient", rs)
+	}
+
+	p.Revoked = append(p.Revoked, escrow.String())
+	if _, err := p.Apply([]age.Recipient{x25519}); err == nil {
+		t.Error("revoked escrow recipient accepted")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age/internal/format"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// A Prompter lets identities and applications interact with the user, for
+// example to request the passphrase of an encrypted key. Messages don't end
+// with punctuation or whitespace, which is up to the implementation.
+type Prompter interface {
+	// RequestSecret asks the user for a secret, such as a passphrase.
+	RequestSecret(message string) ([]byte, error)
+
+	// Confirm asks the user a yes or no question.
+	Confirm(message string) (bool, error)
+
+	// Display shows an informational message to the user.
+	Display(message string)
+}
+
+// A PromptingIdentity is an identity that might need to interact with the
+// user to unwrap a file key. DecryptWithOptions calls UnwrapStanzasWithPrompter
+// instead of UnwrapStanzas if DecryptOptions.Prompter is set, with the context
+// passed to DecryptContext, or context.Background().
+type PromptingIdentity interface {
+	StanzasIdentity
+	UnwrapStanzasWithPrompter(ctx context.Context, stanzas []*format.Recipient, p Prompter) (fileKey []byte, err error)
+}
+
+// ErrPromptDenied is returned by DenyPrompter.
+var ErrPromptDenied = errors.New("interactive prompts are disabled")
+
+// DenyPrompter is a Prompter that refuses all requests, for non-interactive
+// applications. Messages are discarded.
+type DenyPrompter struct{}
+
+func (DenyPrompter) RequestSecret(message string) ([]byte, error) { return nil, ErrPromptDenied }
+func (DenyPrompter) Confirm(message string) (bool, error)         { return false, ErrPromptDenied }
+func (DenyPrompter) Display(message string)                       {}
+
+func prompterOrDeny(p Prompter) Prompter {
+	if p == nil {
+		return DenyPrompter{}
+	}
+	return p
+}
+
+// StaticPrompter is a Prompter that answers every request with fixed values,
+// for applications that obtained the secret in advance. Messages are
+// discarded.
+type StaticPrompter struct {
+	Secret       []byte
+	Confirmation bool
+}
+
+func (p *StaticPrompter) RequestSecret(message string) ([]byte, error) {
+	return p.Secret, nil
+}
+
+func (p *StaticPrompter) Confirm(message string) (bool, error) {
+	return p.Confirmation, nil
+}
+
+func (p *StaticPrompter) Display(message string) {}
+
+// TerminalPrompter is a Prompter that interacts with the user through the
+// terminal, displaying messages on standard error.
+type TerminalPrompter struct {
+	// StdinInUse must be set if standard input is used for other purposes,
+	// such as reading the file to encrypt or decrypt, in which case input is
+	// always read from /dev/tty.
+	StdinInUse bool
+}
+
+func (p *TerminalPrompter) RequestSecret(message string) ([]byte, error) {
+	fmt.Fprintf(os.Stderr, "%s: ", message)
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) || p.StdinInUse {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return nil, fmt.Errorf("standard input is not available or not a terminal, and opening /dev/tty failed: %v", err)
+		}
+		defer tty.Close()
+		fd = int(tty.Fd())
+	}
+	defer fmt.Fprintf(os.Stderr, "\n")
+	s, err := terminal.ReadPassword(fd)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *TerminalPrompter) Confirm(message string) (bool, error) {
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", message)
+	in := os.Stdin
+	if !terminal.IsTerminal(int(in.Fd())) || p.StdinInUse {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return false, fmt.Errorf("standard input is not available or not a terminal, and opening /dev/tty failed: %v", err)
+		}
+		defer tty.Close()
+		in = tty
+	}
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *TerminalPrompter) Display(message string) {
+	fmt.Fprintf(os.Stderr, "%s\n", message)
+}
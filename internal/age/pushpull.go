@@ -0,0 +1,160 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"filippo.io/age/internal/stream"
+)
+
+// EncryptReader is like Encrypt, but returns a Reader of the encrypted file,
+// reading the plaintext from src as needed. It's useful when the ciphertext
+// must be consumed as a Reader, such as an HTTP request body. Read errors
+// from src are returned by the Reader.
+func EncryptReader(src io.Reader, recipients ...Recipient) (io.Reader, error) {
+	hdr := &bytes.Buffer{}
+	payloadCipher, payloadKey, err := encryptHeader(context.Background(), hdr, &EncryptOptions{}, recipients)
+	if err != nil {
+		return nil, err
+	}
+	r, err := stream.NewEncryptReaderWithCipher(payloadCipher, payloadKey, src)
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(hdr, r), nil
+}
+
+// maxHeaderSize is the most DecryptWriter will buffer looking for the end of
+// the header.
+const maxHeaderSize = 1 << 20
+
+// DecryptWriter is like Decrypt, but returns a WriteCloser to which the
+// encrypted file is written, and which writes the plaintext to dst. Armored
+// files are not supported.
+//
+// Identities are tried, and may prompt the user, as soon as the header has
+// been written. Errors, including from dst, are returned by Write or Close.
+// Close must be called to check the end of the file, and an error from it
+// means the plaintext written to dst is truncated. Close doesn't close dst.
+func DecryptWriter(dst io.Writer, identities ...Identity) (io.WriteCloser, error) {
+	if len(identities) == 0 {
+		return nil, errors.New("no identities specified")
+	}
+	return &decryptWriter{dst: dst, identities: identities}, nil
+}
+
+type decryptWriter struct {
+	dst        io.Writer
+	identities []Identity
+
+	header []byte // buffered until w.payload is set
+	// footerEnd is the length of the header up to the end of the MAC line, or
+	// zero if it wasn't seen yet.
+	footerEnd int
+
+	payload *stream.DecryptWriter
+	err     error
+}
+
+func (w *decryptWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.payload != nil {
+		n, err := w.payload.Write(p)
+		if err != nil {
+			w.err = err
+		}
+		return n, err
+	}
+
+	w.header = append(w.header, p...)
+	if err := w.startPayload(); err != nil {
+		w.err = err
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// startPayload parses the header and sets w.payload if enough of the file
+// was buffered to include the header and the nonce.
+func (w *decryptWriter) startPayload() error {
+	if bytes.HasPrefix(w.header, []byte("-----BEGIN")) {
+		return errors.New("armored files are not supported by DecryptWriter")
+	}
+	if w.footerEnd == 0 {
+		// The MAC line is the only one that starts with "---".
+		i := bytes.Index(w.header, []byte("\n---"))
+		if i < 0 {
+			return checkHeaderSize(len(w.header))
+		}
+		end := bytes.IndexByte(w.header[i+1:], '\n')
+		if end < 0 {
+			return checkHeaderSize(len(w.header))
+		}
+		w.footerEnd = i + 1 + end + 1
+	}
+	if len(w.header) < w.footerEnd+16 {
+		return nil
+	}
+
+	h, err := ParseHeader(bytes.NewReader(w.header))
+	if err != nil {
+		return err
+	}
+	if len(h.extensions) > 0 {
+		return fmt.Errorf("payload extensions are not supported by DecryptWriter: %v", h.extensions)
+	}
+	fileKey, err := h.Unwrap(w.identities...)
+	if err != nil {
+		return err
+	}
+	payloadKey, err := h.payloadKey(fileKey)
+	if err != nil {
+		return err
+	}
+	rest, err := ioutil.ReadAll(h.payload)
+	if err != nil {
+		return err
+	}
+	w.payload, err = stream.NewDecryptWriterWithCipher(h.payloadCipher, payloadKey, w.dst)
+	if err != nil {
+		return err
+	}
+	w.header = nil
+	_, err = w.payload.Write(rest)
+	return err
+}
+
+func checkHeaderSize(n int) error {
+	if n > maxHeaderSize {
+		return fmt.Errorf("failed to read header: longer than %d bytes", maxHeaderSize)
+	}
+	return nil
+}
+
+func (w *decryptWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.payload == nil {
+		w.err = errors.New("failed to read header: unexpected EOF")
+		return w.err
+	}
+	w.err = w.payload.Close()
+	if w.err == nil {
+		w.err = errors.New("DecryptWriter is already closed")
+		return nil
+	}
+	return w.err
+}
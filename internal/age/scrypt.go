@@ -7,9 +7,11 @@
 package age
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
 
 	"filippo.io/age/internal/format"
@@ -24,10 +26,18 @@ type ScryptRecipient struct {
 	workFactor int
 }
 
-var _ Recipient = &ScryptRecipient{}
+var _ RecipientWithLabels = &ScryptRecipient{}
+var _ RecipientWithRand = &ScryptRecipient{}
+var _ RecipientWithContext = &ScryptRecipient{}
 
 func (*ScryptRecipient) Type() string { return "scrypt" }
 
+// Labels returns "passphrase", so that an scrypt recipient must be the only
+// recipient of a file.
+func (r *ScryptRecipient) Labels() []string {
+	return []string{passphraseLabel}
+}
+
 func NewScryptRecipient(password string) (*ScryptRecipient, error) {
 	if len(password) == 0 {
 		return nil, errors.New("passphrase can't be empty")
@@ -50,8 +60,22 @@ func (r *ScryptRecipient) SetWorkFactor(logN int) {
 }
 
 func (r *ScryptRecipient) Wrap(fileKey []byte) (*format.Recipient, error) {
+	return r.WrapWithRand(fileKey, rand.Reader)
+}
+
+func (r *ScryptRecipient) WrapWithRand(fileKey []byte, random io.Reader) (*format.Recipient, error) {
+	return r.wrap(context.Background(), fileKey, random)
+}
+
+// WrapContext is like Wrap, but returns ctx.Err() without waiting for scrypt
+// to complete if ctx is done first.
+func (r *ScryptRecipient) WrapContext(ctx context.Context, fileKey []byte) (*format.Recipient, error) {
+	return r.wrap(ctx, fileKey, rand.Reader)
+}
+
+func (r *ScryptRecipient) wrap(ctx context.Context, fileKey []byte, random io.Reader) (*format.Recipient, error) {
 	salt := make([]byte, 16)
-	if _, err := rand.Read(salt[:]); err != nil {
+	if _, err := io.ReadFull(random, salt); err != nil {
 		return nil, err
 	}
 
@@ -62,9 +86,9 @@ func (r *ScryptRecipient) Wrap(fileKey []byte) (*format.Recipient, error) {
 	}
 
 	salt = append([]byte(scryptLabel), salt...)
-	k, err := scrypt.Key(r.password, salt, 1<<logN, 8, 1, chacha20poly1305.KeySize)
+	k, err := scryptKey(ctx, r.password, salt, logN)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate scrypt hash: %v", err)
+		return nil, err
 	}
 
 	wrappedKey, err := aeadEncrypt(k, fileKey)
@@ -81,7 +105,7 @@ type ScryptIdentity struct {
 	maxWorkFactor int
 }
 
-var _ Identity = &ScryptIdentity{}
+var _ IdentityWithContext = &ScryptIdentity{}
 
 func (*ScryptIdentity) Type() string { return "scrypt" }
 
@@ -106,6 +130,12 @@ func (i *ScryptIdentity) SetMaxWorkFactor(logN int) {
 }
 
 func (i *ScryptIdentity) Unwrap(block *format.Recipient) ([]byte, error) {
+	return i.UnwrapContext(context.Background(), block)
+}
+
+// UnwrapContext is like Unwrap, but returns ctx.Err() without waiting for
+// scrypt to complete if ctx is done first.
+func (i *ScryptIdentity) UnwrapContext(ctx context.Context, block *format.Recipient) ([]byte, error) {
 	if block.Type != "scrypt" {
 		return nil, ErrIncorrectIdentity
 	}
@@ -131,9 +161,9 @@ func (i *ScryptIdentity) Unwrap(block *format.Recipient) ([]byte, error) {
 	}
 
 	salt = append([]byte(scryptLabel), salt...)
-	k, err := scrypt.Key(i.password, salt, 1<<logN, 8, 1, chacha20poly1305.KeySize)
+	k, err := scryptKey(ctx, i.password, salt, logN)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate scrypt hash: %v", err)
+		return nil, err
 	}
 
 	fileKey, err := aeadDecrypt(k, block.Body)
@@ -142,3 +172,35 @@ func (i *ScryptIdentity) Unwrap(block *format.Recipient) ([]byte, error) {
 	}
 	return fileKey, nil
 }
+
+// scryptKey derives the wrapping key. scrypt can't be interrupted, so if ctx
+// can be cancelled the computation runs in its own goroutine, which is left
+// to complete in the background if ctx is done first.
+func scryptKey(ctx context.Context, password, salt []byte, logN int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		k, err := scrypt.Key(password, salt, 1<<logN, 8, 1, chacha20poly1305.KeySize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate scrypt hash: %v", err)
+		}
+		return k, nil
+	}
+
+	type result struct {
+		k   []byte
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		k, err := scryptKey(context.Background(), password, salt, logN)
+		c <- result{k, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-c:
+		return r.k, r.err
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package age
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"filippo.io/age/internal/stream"
+)
+
+// Seal encrypts a short plaintext, such as a token or a database field, to
+// recipients, and returns the encrypted file. The output is the same as
+// Encrypt's, but it's produced in a single pre-sized buffer.
+func Seal(plaintext []byte, recipients ...Recipient) ([]byte, error) {
+	// An X25519 stanza is 98 bytes, and the intro, MAC line and nonce 103.
+	sizeHint := 128 + 128*len(recipients) + int(stream.EncryptedSize(int64(len(plaintext))))
+	hdr := bytes.NewBuffer(make([]byte, 0, sizeHint))
+	payloadCipher, payloadKey, err := encryptHeader(context.Background(), hdr, &EncryptOptions{}, recipients)
+	if err != nil {
+		return nil, err
+	}
+	return stream.Seal(payloadCipher, payloadKey, hdr.Bytes(), plaintext)
+}
+
+// Open decrypts a file produced by Seal or Encrypt, which can be armored, and
+// returns the plaintext. ciphertext is not modified.
+func Open(ciphertext []byte, identities ...Identity) ([]byte, error) {
+	return OpenWithOptions(ciphertext, nil, identities...)
+}
+
+// OpenWithOptions is like Open, but takes the same options as
+// DecryptWithOptions, such as a Prompter for LazyScryptIdentity.
+func OpenWithOptions(ciphertext []byte, opts *DecryptOptions, identities ...Identity) ([]byte, error) {
+	h, err := ParseHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	fileKey, _, err := h.UnwrapWithOptions(opts, identities...)
+	if err != nil {
+		return nil, err
+	}
+	payloadKey, err := h.payloadKey(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The payload is shorter than the whole file, so ReadFull will stop at
+	// the end of it with ErrUnexpectedEOF.
+	payload := make([]byte, len(ciphertext))
+	n, err := io.ReadFull(h.payload, payload)
+	if err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to read payload: %v", err)
+	}
+	plaintext, err := stream.Open(h.payloadCipher, payloadKey, payload[:n])
+	if err != nil || len(h.extensions) == 0 {
+		return plaintext, err
+	}
+	r, err := h.wrapPayloadReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// EncryptedColumn is a database/sql Valuer and Scanner that stores Plaintext
+// encrypted with Seal, and decrypts it with Open. A nil Plaintext is stored
+// as NULL.
+//
+// Recipients must be set to store a value, and Identities to scan one.
+type EncryptedColumn struct {
+	Plaintext []byte
+
+	Recipients []Recipient
+	Identities []Identity
+}
+
+var _ driver.Valuer = EncryptedColumn{}
+
+func (c EncryptedColumn) Value() (driver.Value, error) {
+	if c.Plaintext == nil {
+		return nil, nil
+	}
+	return Seal(c.Plaintext, c.Recipients...)
+}
+
+func (c *EncryptedColumn) Scan(src interface{}) error {
+	var ciphertext []byte
+	switch src := src.(type) {
+	case nil:
+		c.Plaintext = nil
+		return nil
+	case []byte:
+		ciphertext = src
+	case string:
+		ciphertext = []byte(src)
+	default:
+		return fmt.Errorf("age: can't scan %T into an EncryptedColumn", src)
+	}
+	plaintext, err := Open(ciphertext, c.Identities...)
+	if err != nil {
+		return err
+	}
+	c.Plaintext = plaintext
+	return nil
+}
@@ -38,7 +38,7 @@ type SSHRSARecipient struct {
 	pubKey *rsa.PublicKey
 }
 
-var _ Recipient = &SSHRSARecipient{}
+var _ RecipientWithRand = &SSHRSARecipient{}
 
 func (*SSHRSARecipient) Type() string { return "ssh-rsa" }
 
@@ -63,12 +63,16 @@ func NewSSHRSARecipient(pk ssh.PublicKey) (*SSHRSARecipient, error) {
 }
 
 func (r *SSHRSARecipient) Wrap(fileKey []byte) (*format.Recipient, error) {
+	return r.WrapWithRand(fileKey, rand.Reader)
+}
+
+func (r *SSHRSARecipient) WrapWithRand(fileKey []byte, random io.Reader) (*format.Recipient, error) {
 	l := &format.Recipient{
 		Type: "ssh-rsa",
 		Args: []string{SSHFingerprint(r.sshKey)},
 	}
 
-	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader,
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), random,
 		r.pubKey, fileKey, []byte(oaepLabel))
 	if err != nil {
 		return nil, err
@@ -123,7 +127,7 @@ type SSHEd25519Recipient struct {
 	theirPublicKey []byte
 }
 
-var _ Recipient = &SSHEd25519Recipient{}
+var _ RecipientWithRand = &SSHEd25519Recipient{}
 
 func (*SSHEd25519Recipient) Type() string { return "ssh-ed25519" }
 
@@ -203,8 +207,12 @@ func ed25519PublicKeyToCurve25519(pk ed25519.PublicKey) []byte {
 const ed25519Label = "age-encryption.org/v1/ssh-ed25519"
 
 func (r *SSHEd25519Recipient) Wrap(fileKey []byte) (*format.Recipient, error) {
+	return r.WrapWithRand(fileKey, rand.Reader)
+}
+
+func (r *SSHEd25519Recipient) WrapWithRand(fileKey []byte, random io.Reader) (*format.Recipient, error) {
 	ephemeral := make([]byte, curve25519.ScalarSize)
-	if _, err := rand.Read(ephemeral); err != nil {
+	if _, err := io.ReadFull(random, ephemeral); err != nil {
 		return nil, err
 	}
 	ourPublicKey, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
@@ -279,6 +287,9 @@ func ParseSSHIdentity(pemBytes []byte) (Identity, error) {
 	switch k := k.(type) {
 	case *ed25519.PrivateKey:
 		return NewSSHEd25519Identity(*k)
+	case ed25519.PrivateKey:
+		// PKCS#8 keys are returned by value.
+		return NewSSHEd25519Identity(k)
 	case *rsa.PrivateKey:
 		return NewSSHRSAIdentity(k)
 	}
@@ -0,0 +1,14 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build age_testrand
+// +build age_testrand
+
+package age
+
+func init() {
+	testOnlyRandAllowed = true
+}
@@ -27,7 +27,7 @@ type X25519Recipient struct {
 	theirPublicKey []byte
 }
 
-var _ Recipient = &X25519Recipient{}
+var _ RecipientWithRand = &X25519Recipient{}
 
 func (*X25519Recipient) Type() string { return "X25519" }
 
@@ -58,8 +58,12 @@ func ParseX25519Recipient(s string) (*X25519Recipient, error) {
 }
 
 func (r *X25519Recipient) Wrap(fileKey []byte) (*format.Recipient, error) {
+	return r.WrapWithRand(fileKey, rand.Reader)
+}
+
+func (r *X25519Recipient) WrapWithRand(fileKey []byte, random io.Reader) (*format.Recipient, error) {
 	ephemeral := make([]byte, curve25519.ScalarSize)
-	if _, err := rand.Read(ephemeral); err != nil {
+	if _, err := io.ReadFull(random, ephemeral); err != nil {
 		return nil, err
 	}
 	ourPublicKey, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
@@ -0,0 +1,297 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// Package agehttp implements net/http middlewares that encrypt response
+// bodies and decrypt request bodies with age.
+package agehttp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"filippo.io/age/internal/age"
+	"filippo.io/age/internal/format"
+	"filippo.io/age/internal/stream"
+)
+
+// ContentType is the media type of age encrypted files.
+const ContentType = "application/age"
+
+// ResponseOptions are optional settings for EncryptResponse.
+type ResponseOptions struct {
+	// Armor wraps the response in the ASCII armor format.
+	Armor bool
+}
+
+// EncryptResponse returns a handler that encrypts the response bodies of h
+// to recipients, and sets their Content-Type to application/age.
+//
+// If h sets the Content-Length header, it's replaced with the length of the
+// encrypted body. Responses with a status that doesn't allow a body, like
+// 204 No Content, are passed through unmodified.
+func EncryptResponse(h http.Handler, opts *ResponseOptions, recipients ...age.Recipient) http.Handler {
+	if opts == nil {
+		opts = &ResponseOptions{}
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := &encryptingWriter{ResponseWriter: rw, opts: opts, recipients: recipients}
+		h.ServeHTTP(w, r)
+		if err := w.close(); err != nil {
+			// The response is already partially sent, and the client will
+			// detect the truncation, but abort the connection to make it clear.
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+type encryptingWriter struct {
+	http.ResponseWriter
+	opts       *ResponseOptions
+	recipients []age.Recipient
+
+	wroteHeader bool
+	passthrough bool
+	err         error
+
+	w     io.WriteCloser // the age Writer
+	armor io.WriteCloser // the ArmoredWriter, if opts.Armor is set
+	dst   switchWriter
+}
+
+// switchWriter buffers the start of the output until the Content-Length is
+// known and the status line is sent.
+type switchWriter struct{ io.Writer }
+
+// countingWriter counts the bytes written before they are armored.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *encryptingWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if !bodyAllowed(code) {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	h := w.Header()
+	plaintextLen, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil {
+		plaintextLen = -1
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Type", ContentType)
+
+	buf := &bytes.Buffer{}
+	w.dst.Writer = buf
+	counter := &countingWriter{Writer: &w.dst}
+	if w.opts.Armor {
+		w.armor = format.ArmoredWriter(&w.dst)
+		counter.Writer = w.armor
+	}
+	w.w, err = age.Encrypt(counter, w.recipients...)
+	if err != nil {
+		w.err = err
+		h.Del("Content-Type")
+		w.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if plaintextLen >= 0 {
+		size := counter.n + stream.EncryptedSize(plaintextLen)
+		if w.opts.Armor {
+			size = format.ArmoredSize(size)
+		}
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.ResponseWriter.WriteHeader(code)
+	w.dst.Writer = w.ResponseWriter
+	if _, err := buf.WriteTo(w.ResponseWriter); err != nil {
+		w.err = err
+	}
+}
+
+func bodyAllowed(code int) bool {
+	switch {
+	case code >= 100 && code <= 199:
+		return false
+	case code == http.StatusNoContent, code == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passthrough {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *encryptingWriter) close() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passthrough {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	if w.armor != nil {
+		return w.armor.Close()
+	}
+	return nil
+}
+
+// RequestOptions are optional settings for DecryptRequest.
+type RequestOptions struct {
+	// MaxSize is the maximum size of an encrypted request body. If zero,
+	// there is no limit.
+	MaxSize int64
+}
+
+// ErrTooLarge is returned when reading a request body larger than
+// RequestOptions.MaxSize.
+var ErrTooLarge = errors.New("request body too large")
+
+// DecryptRequest returns a handler that decrypts the bodies of requests with
+// identities before passing them to h. Requests with a different
+// Content-Type than application/age are rejected.
+//
+// If the header of the body can't be decrypted, h is not called, and the
+// request fails with 400 Bad Request if it's malformed or doesn't match its
+// MAC, 403 Forbidden if it's not encrypted to any of the identities, or 413
+// Request Entity Too Large if it exceeds RequestOptions.MaxSize.
+//
+// The rest of the body is decrypted as h reads it, and h must check the
+// errors returned by Read, which can be passed to StatusCode, before acting
+// on the request.
+func DecryptRequest(h http.Handler, opts *RequestOptions, identities ...age.Identity) http.Handler {
+	if opts == nil {
+		opts = &RequestOptions{}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != ContentType {
+			http.Error(w, "expected Content-Type "+ContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		limit := &limitedReader{r: r.Body, n: opts.MaxSize}
+		var body io.Reader = r.Body
+		if opts.MaxSize > 0 {
+			if r.ContentLength > opts.MaxSize {
+				http.Error(w, ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			body = limit
+		}
+
+		hdr, err := age.ParseHeader(body)
+		if err != nil {
+			if limit.n < 0 {
+				http.Error(w, ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		fileKey, err := hdr.Unwrap(identities...)
+		switch {
+		case errors.Is(err, age.ErrNoIdentityMatch):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, age.ErrBadHeaderMAC):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, "failed to decrypt request", http.StatusInternalServerError)
+			return
+		}
+		plaintext, err := hdr.Open(fileKey)
+		if err != nil {
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Body = &decryptedBody{Reader: plaintext, Closer: r.Body}
+		r2.ContentLength = -1
+		r2.Header = r.Header.Clone()
+		r2.Header.Del("Content-Length")
+		r2.Header.Del("Content-Type")
+		h.ServeHTTP(w, r2)
+	})
+}
+
+type decryptedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// limitedReader is like io.LimitedReader, but returns ErrTooLarge instead of
+// io.EOF if the source is longer than n.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrTooLarge
+	}
+	// Allow reading one more byte than the limit, to tell EOF apart.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), ErrTooLarge
+	}
+	return n, err
+}
+
+// StatusCode returns the HTTP status code for an error returned by Read on a
+// request body decrypted by DecryptRequest: 413 Request Entity Too Large for
+// ErrTooLarge, and 400 Bad Request otherwise, as the body was truncated or
+// failed to authenticate.
+func StatusCode(err error) int {
+	if errors.Is(err, ErrTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
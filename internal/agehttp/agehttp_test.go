@@ -0,0 +1,120 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package agehttp_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"filippo.io/age/internal/age"
+	"filippo.io/age/internal/agehttp"
+)
+
+func TestEncryptResponse(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, length := range []int{0, 1, 1000, 64 * 1024, 200 * 1024} {
+		for _, armor := range []bool{false, true} {
+			t.Run(fmt.Sprintf("len=%d,armor=%v", length, armor), func(t *testing.T) {
+				body := bytes.Repeat([]byte("A"), length)
+				h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+					w.Write(body)
+				})
+				rec := httptest.NewRecorder()
+				opts := &agehttp.ResponseOptions{Armor: armor}
+				agehttp.EncryptResponse(h, opts, i.Recipient()).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+				if ct := rec.Header().Get("Content-Type"); ct != agehttp.ContentType {
+					t.Errorf("Content-Type is %q", ct)
+				}
+				if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(rec.Body.Len()) {
+					t.Errorf("Content-Length is %s, but the body is %d bytes", cl, rec.Body.Len())
+				}
+				out, err := age.Decrypt(rec.Body, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				outBytes, err := ioutil.ReadAll(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(outBytes, body) {
+					t.Error("wrong decrypted body")
+				}
+			})
+		}
+	}
+}
+
+func TestDecryptRequest(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := age.Seal([]byte(strings.Repeat("A", 100000)), i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), agehttp.StatusCode(err))
+			return
+		}
+		fmt.Fprintf(w, "%d", len(body))
+	})
+	badMAC := append([]byte{}, file...)
+	badMAC[bytes.Index(badMAC, []byte("\n---"))+10] ^= 1
+
+	for _, tc := range []struct {
+		name        string
+		body        []byte
+		contentType string
+		maxSize     int64
+		identity    age.Identity
+		status      int
+	}{
+		{"ok", file, agehttp.ContentType, 0, i, http.StatusOK},
+		{"content type", file, "text/plain", 0, i, http.StatusUnsupportedMediaType},
+		{"wrong identity", file, agehttp.ContentType, 0, other, http.StatusForbidden},
+		{"bad MAC", badMAC, agehttp.ContentType, 0, i, http.StatusBadRequest},
+		{"truncated", file[:len(file)-100], agehttp.ContentType, 0, i, http.StatusBadRequest},
+		{"malformed", []byte("hello"), agehttp.ContentType, 0, i, http.StatusBadRequest},
+		{"too large", file, agehttp.ContentType, 1000, i, http.StatusRequestEntityTooLarge},
+		{"too large header", file, agehttp.ContentType, 50, i, http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", bytes.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			// Hide the Content-Length to exercise the streaming limit.
+			req.ContentLength = -1
+			rec := httptest.NewRecorder()
+			opts := &agehttp.RequestOptions{MaxSize: tc.maxSize}
+			agehttp.DecryptRequest(h, opts, tc.identity).ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Errorf("got status %d (%q), expected %d", rec.Code, rec.Body, tc.status)
+			}
+			if tc.status == http.StatusOK && rec.Body.String() != "100000" {
+				t.Errorf("handler read %s bytes", rec.Body)
+			}
+		})
+	}
+}
@@ -92,6 +92,14 @@ func ArmoredWriter(dst io.Writer) io.WriteCloser {
 			&newlineWriter{dst: dst})}
 }
 
+// ArmoredSize returns the size of the output of ArmoredWriter for an input of
+// n bytes, with n > 0.
+func ArmoredSize(n int64) int64 {
+	encoded := (n + 2) / 3 * 4 // padded base64
+	lines := (encoded + columnsPerLine - 1) / columnsPerLine
+	return int64(len(armorPreamble)+1) + encoded + lines - 1 + int64(1+len(armorEnd)+1)
+}
+
 type armoredReader struct {
 	r       *bufio.Reader
 	started bool
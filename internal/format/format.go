@@ -18,10 +18,28 @@ import (
 )
 
 type Header struct {
+	// Version is the intro line of the header, without the trailing newline,
+	// identifying the format version. If empty, V1 is used.
+	Version    string
 	Recipients []*Recipient
 	MAC        []byte
 }
 
+// Format versions, as they appear in the header intro line.
+const (
+	// V1 is age-encryption.org/v1, with a ChaCha20-Poly1305 STREAM payload.
+	V1 = "age-encryption.org/v1"
+
+	// V1AESGCM is an experimental variant of V1 where the payload STREAM uses
+	// AES-256-GCM instead of ChaCha20-Poly1305. The header, recipient stanzas
+	// and key derivations are unchanged.
+	V1AESGCM = "age-encryption.org/v1-aes-256-gcm"
+)
+
+func knownVersion(v string) bool {
+	return v == V1 || v == V1AESGCM
+}
+
 type Recipient struct {
 	Type string
 	Args []string
@@ -43,8 +61,6 @@ var EncodeToString = b64.EncodeToString
 const columnsPerLine = 64
 const bytesPerLine = columnsPerLine / 4 * 3
 
-const intro = "age-encryption.org/v1\n"
-
 var recipientPrefix = []byte("->")
 var footerPrefix = []byte("---")
 
@@ -72,7 +88,11 @@ func (r *Recipient) Marshal(w io.Writer) error {
 }
 
 func (h *Header) MarshalWithoutMAC(w io.Writer) error {
-	if _, err := io.WriteString(w, intro); err != nil {
+	version := h.Version
+	if version == "" {
+		version = V1
+	}
+	if _, err := io.WriteString(w, version+"\n"); err != nil {
 		return err
 	}
 	for _, r := range h.Recipients {
@@ -120,7 +140,9 @@ func Parse(input io.Reader) (*Header, io.Reader, error) {
 	if err != nil {
 		return nil, nil, errorf("failed to read intro: %v", err)
 	}
-	if line != intro {
+	if v := strings.TrimSuffix(line, "\n"); knownVersion(v) {
+		h.Version = v
+	} else {
 		return nil, nil, errorf("unexpected intro: %q", line)
 	}
 
@@ -0,0 +1,375 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// Package segment splits an age file into numbered segment files of a
+// maximum size, and joins them back together.
+//
+// Each segment starts with a line "age-segment/v1 INDEX more", or "... last"
+// for the last segment, which is marked once the Writer is closed. The first
+// segment holds the header, and the segments are split at payload chunk
+// boundaries, so that each chunk is in a single segment.
+//
+// The index line is not authenticated by itself, but each payload chunk is
+// authenticated along with its position in the file. A segment that is
+// relabelled, swapped or otherwise out of place makes its first chunk fail
+// to decrypt, and Reader.Locate maps that chunk back to the segment. Missing
+// segments after a forged last marker make decryption fail as truncated at
+// the end of the last segment.
+package segment
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"filippo.io/age/internal/stream"
+)
+
+const intro = "age-segment/v1 "
+
+// The markers have the same length, so that the last one can be rewritten.
+const (
+	moreMarker = "more"
+	lastMarker = "last"
+)
+
+const (
+	// chunkSize is the size of an encrypted payload chunk, including its tag.
+	chunkSize = stream.ChunkSize + 16
+	// nonceSize is the size of the payload nonce, after the header.
+	nonceSize = 16
+	// maxLineSize is the size of the longest possible index line.
+	maxLineSize = len(intro) + 19 + len(" more\n")
+)
+
+// MinSize is the smallest segment size accepted by NewWriter. A segment must
+// fit at least a payload chunk and its index line.
+const MinSize = int64(chunkSize + maxLineSize)
+
+// Name returns the name of the segment file with the given index.
+func Name(name string, index int) string {
+	return fmt.Sprintf("%s.%03d", name, index)
+}
+
+// A Writer splits the age file written to it into new segment files, named
+// after Name, each at most size bytes long, including the index line. The
+// file must not be armored.
+type Writer struct {
+	name  string
+	size  int64
+	f     *os.File
+	index int   // of the next segment
+	left  int64 // bytes that still fit in f
+
+	header    []byte // buffered until the end of the header and nonce
+	inPayload bool
+	chunkLeft int64 // bytes left in the current payload chunk
+}
+
+// NewWriter returns a Writer that creates the segments of the file name.
+// The segment files must not exist. They are created as data is written.
+func NewWriter(name string, size int64) (*Writer, error) {
+	if size < MinSize {
+		return nil, fmt.Errorf("segment size must be at least %d bytes", MinSize)
+	}
+	return &Writer{name: name, size: size}, nil
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	if !w.inPayload {
+		w.header = append(w.header, p...)
+		end := headerEnd(w.header)
+		if end < 0 {
+			if int64(len(w.header)) > w.size {
+				return 0, errors.New("the header doesn't fit in a segment")
+			}
+			return len(p), nil
+		}
+		if err := w.nextSegment(); err != nil {
+			return 0, err
+		}
+		if int64(end) > w.left {
+			return 0, errors.New("the header doesn't fit in a segment")
+		}
+		if _, err := w.f.Write(w.header[:end]); err != nil {
+			return 0, err
+		}
+		w.left -= int64(end)
+		w.inPayload = true
+		// The bytes after the header and nonce are the start of the payload,
+		// and are at the end of p, as the previous Writes didn't complete
+		// the header.
+		rest := len(w.header) - end
+		w.header = nil
+		n, err := w.writePayload(p[len(p)-rest:])
+		return len(p) - rest + n, err
+	}
+	return w.writePayload(p)
+}
+
+// headerEnd returns the length of the header and nonce at the start of b, or
+// -1 if b doesn't hold all of them yet. The header ends with the MAC line,
+// the only one starting with "---".
+func headerEnd(b []byte) int {
+	i := bytes.Index(b, []byte("\n---"))
+	if i < 0 {
+		return -1
+	}
+	j := bytes.IndexByte(b[i+1:], '\n')
+	if j < 0 {
+		return -1
+	}
+	end := i + 1 + j + 1 + nonceSize
+	if len(b) < end {
+		return -1
+	}
+	return end
+}
+
+func (w *Writer) writePayload(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if w.chunkLeft == 0 {
+			// Start each chunk in a segment that can hold all of it.
+			if w.left < chunkSize {
+				if err := w.nextSegment(); err != nil {
+					return n, err
+				}
+			}
+			w.chunkLeft = chunkSize
+		}
+		chunk := p
+		if int64(len(chunk)) > w.chunkLeft {
+			chunk = chunk[:w.chunkLeft]
+		}
+		nn, err := w.f.Write(chunk)
+		n += nn
+		w.left -= int64(nn)
+		w.chunkLeft -= int64(nn)
+		p = p[nn:]
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (w *Writer) nextSegment() error {
+	if w.f != nil {
+		err := w.f.Close()
+		w.f = nil
+		if err != nil {
+			return err
+		}
+	}
+	name := Name(w.name, w.index)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	line := intro + strconv.Itoa(w.index) + " " + moreMarker + "\n"
+	if _, err := io.WriteString(f, line); err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.left = f, w.size-int64(len(line))
+	w.index++
+	return nil
+}
+
+// Close marks the current segment as the last one, and closes it. If Close
+// is not called, or fails, the segments can't be joined.
+func (w *Writer) Close() error {
+	if w.f == nil {
+		if !w.inPayload && len(w.header) > 0 {
+			return errors.New("the input is not an age file")
+		}
+		return nil
+	}
+	offset := int64(len(intro) + len(strconv.Itoa(w.index-1)) + 1)
+	_, err := w.f.WriteAt([]byte(lastMarker), offset)
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+// IsSegment reports whether the file at name starts like a segment. Only
+// regular files are checked, so that the start of a pipe is not consumed.
+func IsSegment(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	buf := make([]byte, len(intro))
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return false
+	}
+	return string(buf) == intro
+}
+
+// Join returns a Reader for the contents of the named segment files, in the
+// order of their indexes, which must go from zero to len(names)-1 without
+// gaps or duplicates. The files are opened one at a time, as they are read.
+func Join(names ...string) (*Reader, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no segments specified")
+	}
+	byIndex := make(map[int]string)
+	sizes := make(map[int]int64)
+	last := -1
+	for _, name := range names {
+		index, isLast, size, err := readIndexFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := byIndex[index]; ok {
+			return nil, fmt.Errorf("duplicate segment #%d in %q and %q", index, other, name)
+		}
+		byIndex[index], sizes[index] = name, size
+		if isLast {
+			last = index
+		}
+	}
+	r := &Reader{names: make([]string, len(names)), starts: make([]int64, len(names)+1)}
+	for i := range r.names {
+		name, ok := byIndex[i]
+		if !ok {
+			return nil, fmt.Errorf("missing segment #%d", i)
+		}
+		r.names[i] = name
+		r.starts[i+1] = r.starts[i] + sizes[i]
+	}
+	switch {
+	case last < 0:
+		return nil, fmt.Errorf("missing segments after #%d", len(names)-1)
+	case last != len(names)-1:
+		return nil, fmt.Errorf("segment #%d is marked as the last one, but more follow", last)
+	}
+	return r, nil
+}
+
+// readIndexFile returns the index line of the segment at name, and the size
+// of the data that follows it.
+func readIndexFile(name string) (index int, last bool, size int64, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, false, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, 0, err
+	}
+	index, last, err = readIndex(name, bufio.NewReader(f))
+	if err != nil {
+		return 0, false, 0, err
+	}
+	line := intro + strconv.Itoa(index) + " " + moreMarker + "\n"
+	return index, last, info.Size() - int64(len(line)), nil
+}
+
+func readIndex(name string, r *bufio.Reader) (index int, last bool, err error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || !strings.HasPrefix(string(line), intro) {
+		return 0, false, fmt.Errorf("%q is not an age segment", name)
+	}
+	args := strings.Split(strings.TrimSuffix(string(line[len(intro):]), "\n"), " ")
+	if len(args) != 2 || args[1] != moreMarker && args[1] != lastMarker {
+		return 0, false, fmt.Errorf("malformed index line in segment %q", name)
+	}
+	index, err = strconv.Atoi(args[0])
+	if err != nil || index < 0 || strconv.Itoa(index) != args[0] {
+		return 0, false, fmt.Errorf("malformed index in segment %q", name)
+	}
+	return index, args[1] == lastMarker, nil
+}
+
+// A Reader reads the contents of joined segments.
+type Reader struct {
+	names  []string
+	starts []int64 // offset of each segment in the joined data, and the end
+	index  int     // of the segment in f
+	f      *os.File
+	r      *bufio.Reader
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for {
+		if r.f == nil {
+			if r.index == len(r.names) {
+				return 0, io.EOF
+			}
+			if err := r.openSegment(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.r.Read(p)
+		if err == io.EOF {
+			r.Close()
+			r.index++
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *Reader) openSegment() error {
+	name := r.names[r.index]
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(f)
+	index, _, err := readIndex(name, br)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// The file might have changed since Join read its index.
+	if index != r.index {
+		f.Close()
+		return fmt.Errorf("segment %q changed while reading it", name)
+	}
+	r.f, r.r = f, br
+	return nil
+}
+
+// Locate returns the index and file name of the segment holding offset in
+// the joined data, and whether offset is the start of the segment. The end
+// of the data is located in the last segment.
+func (r *Reader) Locate(offset int64) (index int, name string, start bool) {
+	index = len(r.names) - 1
+	for i := range r.names {
+		if offset < r.starts[i+1] {
+			index = i
+			break
+		}
+	}
+	return index, r.names[index], offset == r.starts[index]
+}
+
+// Close closes the segment file being read, if any.
+func (r *Reader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f, r.r = nil, nil
+	return err
+}
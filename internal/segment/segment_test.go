@@ -0,0 +1,250 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package segment_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age/internal/age"
+	"filippo.io/age/internal/segment"
+	"filippo.io/age/internal/stream"
+)
+
+const encChunkSize = stream.ChunkSize + 16
+
+func encrypt(t *testing.T, i *age.X25519Identity, plaintext []byte) []byte {
+	buf := &bytes.Buffer{}
+	w, err := age.Encrypt(buf, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeSegments(t *testing.T, name string, size int64, data []byte) []string {
+	w, err := segment.NewWriter(name, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in uneven pieces, so that the header is split across Writes.
+	for len(data) > 0 {
+		n := 77
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+		if len(data) > 10000 {
+			if _, err := w.Write(data[:10000]); err != nil {
+				t.Fatal(err)
+			}
+			data = data[10000:]
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	names, err := filepath.Glob(name + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// decrypt joins and decrypts the segments, and returns the segment that
+// decryption failed at, if any.
+func decrypt(t *testing.T, i age.Identity, names []string) (out []byte, index int, start bool, err error) {
+	r, err := segment.Join(names...)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer r.Close()
+	h, err := age.ParseHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKey, err := h.Unwrap(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := h.Open(fileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = ioutil.ReadAll(pr)
+	if err != nil {
+		_, offset := h.Position()
+		index, _, start = r.Locate(offset)
+	}
+	return out, index, start, err
+}
+
+func TestRoundTrip(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, 5*stream.ChunkSize+1000)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	file := encrypt(t, i, plaintext)
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file.age")
+	size := 2*segment.MinSize + 100
+	names := writeSegments(t, name, size, file)
+	// The first segment holds the header and one chunk, the others two, but
+	// the last one, which holds the sixth chunk.
+	if len(names) != 4 {
+		t.Fatalf("got %d segments, expected 4", len(names))
+	}
+	for n, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > size {
+			t.Errorf("segment %q is %d bytes long", name, info.Size())
+		}
+		if !segment.IsSegment(name) {
+			t.Errorf("segment %q not recognized", name)
+		}
+		line := int64(len("age-segment/v1 0 more\n"))
+		if n > 0 && n < len(names)-1 && (info.Size()-line)%encChunkSize != 0 {
+			t.Errorf("segment %q doesn't hold whole chunks", name)
+		}
+	}
+
+	// The order of the names doesn't matter.
+	names[0], names[2] = names[2], names[0]
+	out, _, _, err := decrypt(t, i, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plaintext) {
+		t.Error("joined segments don't decrypt to the plaintext")
+	}
+
+	if _, err := segment.Join(names[1:]...); err == nil {
+		t.Error("joined segments with a missing one")
+	}
+	if _, err := segment.Join(segment.Name(name, 0), segment.Name(name, 1)); err == nil {
+		t.Error("joined segments without the last one")
+	}
+	dup := filepath.Join(dir, "dup")
+	if err := os.Link(segment.Name(name, 1), dup); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := segment.Join(append(names, dup)...); err == nil {
+		t.Error("joined segments with a duplicate one")
+	}
+	if _, err := segment.NewWriter(name, segment.MinSize-1); err == nil {
+		t.Error("accepted a segment size smaller than MinSize")
+	}
+}
+
+func TestOutOfPlace(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := encrypt(t, i, make([]byte, 4*stream.ChunkSize+1000))
+
+	// split writes the file in segments with one chunk each, after the
+	// header in segment 0, and returns their contents.
+	split := func(t *testing.T) (name string, segs [][]byte) {
+		name = filepath.Join(t.TempDir(), "file.age")
+		names := writeSegments(t, name, segment.MinSize, file)
+		for n := range names {
+			b, err := ioutil.ReadFile(segment.Name(name, n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			segs = append(segs, b)
+		}
+		if len(segs) != 6 {
+			t.Fatalf("got %d segments, expected 6", len(segs))
+		}
+		return name, segs
+	}
+	relabel := func(b []byte, from, to string) []byte {
+		line := []byte("age-segment/v1 " + from)
+		if !bytes.HasPrefix(b, line) {
+			t.Fatalf("segment doesn't start with %q", line)
+		}
+		return append([]byte("age-segment/v1 "+to), b[len(line):]...)
+	}
+	write := func(t *testing.T, name string, segs [][]byte) []string {
+		var names []string
+		for n, b := range segs {
+			if err := ioutil.WriteFile(segment.Name(name, n), b, 0666); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, segment.Name(name, n))
+		}
+		os.Remove(segment.Name(name, len(segs)))
+		return names
+	}
+
+	t.Run("relabelled", func(t *testing.T) {
+		name, segs := split(t)
+		segs[2], segs[3] = relabel(segs[3], "3", "2"), relabel(segs[2], "2", "3")
+		_, index, start, err := decrypt(t, i, write(t, name, segs))
+		var authErr *age.ErrChunkAuthentication
+		if !errors.As(err, &authErr) {
+			t.Fatalf("got error %v, expected an authentication failure", err)
+		}
+		if index != 2 || !start {
+			t.Errorf("failed at segment #%d (start: %v), expected the start of #2", index, start)
+		}
+	})
+
+	t.Run("duplicated", func(t *testing.T) {
+		name, segs := split(t)
+		segs[4] = relabel(segs[3], "3", "4")
+		_, index, start, err := decrypt(t, i, write(t, name, segs))
+		var authErr *age.ErrChunkAuthentication
+		if !errors.As(err, &authErr) {
+			t.Fatalf("got error %v, expected an authentication failure", err)
+		}
+		if index != 4 || !start {
+			t.Errorf("failed at segment #%d (start: %v), expected the start of #4", index, start)
+		}
+	})
+
+	t.Run("dropped last", func(t *testing.T) {
+		name, segs := split(t)
+		segs = segs[:len(segs)-1]
+		last := segs[len(segs)-1]
+		segs[len(segs)-1] = bytes.Replace(last, []byte(" more\n"), []byte(" last\n"), 1)
+		out, index, _, err := decrypt(t, i, write(t, name, segs))
+		if err != age.ErrTruncated {
+			t.Fatalf("got error %v, expected ErrTruncated", err)
+		}
+		if index != 4 {
+			t.Errorf("failed at segment #%d, expected #4", index)
+		}
+		if len(out) != 4*stream.ChunkSize {
+			t.Errorf("got %d bytes before the error, expected %d", len(out), 4*stream.ChunkSize)
+		}
+	})
+}
@@ -8,9 +8,12 @@
 package stream
 
 import (
+	"crypto/aes"
 	"crypto/cipher"
 	"errors"
+	"fmt"
 	"io"
+	"sync"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/poly1305"
@@ -18,15 +21,81 @@ import (
 
 const ChunkSize = 64 * 1024
 
+// A Cipher returns the AEAD used to seal the chunks of a STREAM, given a
+// 32-byte key. The AEAD must use 12-byte nonces and 16-byte tags.
+type Cipher func(key []byte) (cipher.AEAD, error)
+
+var (
+	// ChaCha20Poly1305 is the age-encryption.org/v1 payload cipher.
+	ChaCha20Poly1305 Cipher = chacha20poly1305.New
+
+	// AES256GCM is the payload cipher of the experimental AES-GCM variant.
+	AES256GCM Cipher = newAESGCM
+)
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("stream: AES-256-GCM requires a 32-byte key")
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+func newAEAD(c Cipher, key []byte) (cipher.AEAD, error) {
+	aead, err := c(key)
+	if err != nil {
+		return nil, err
+	}
+	if aead.NonceSize() != chacha20poly1305.NonceSize || aead.Overhead() != poly1305.TagSize {
+		return nil, errors.New("stream: unsupported AEAD nonce or tag size")
+	}
+	return aead, nil
+}
+
+// ErrTruncated is returned when a STREAM ends after a chunk that is not marked
+// as the last one. A STREAM truncated within a chunk can't be told apart from
+// a damaged one, and fails with an ErrChunkAuthentication instead.
+var ErrTruncated = errors.New("stream: truncated ciphertext")
+
+// ErrTrailingData is returned when data follows the last chunk of a STREAM.
+var ErrTrailingData = errors.New("stream: trailing data after the last chunk")
+
+// ErrChunkAuthentication is returned when a chunk of a STREAM fails to
+// authenticate. All the chunks before it were authenticated.
+type ErrChunkAuthentication struct {
+	// Index is the index of the chunk, starting at zero.
+	Index int64
+	// Offset is the offset of the chunk from the start of the STREAM.
+	Offset int64
+}
+
+func (e *ErrChunkAuthentication) Error() string {
+	return fmt.Sprintf("stream: chunk #%d at offset %d failed to authenticate", e.Index, e.Offset)
+}
+
 type Reader struct {
 	a   cipher.AEAD
 	src io.Reader
 
-	unread []byte // decrypted but unread data, backed by buf
-	buf    [encChunkSize]byte
+	unread []byte // decrypted but unread data, backed by plain
+
+	// buf holds a chunk of ciphertext, and the first byte of the next one,
+	// which tells that the chunk isn't the last. A failed Open wipes its
+	// output, and a full chunk might have to be opened again with the other
+	// last chunk flag to tell truncation and trailing data from tampering, so
+	// full chunks are decrypted into plain. Short chunks, which can only be
+	// the last one, are decrypted in place.
+	buf     [encChunkSize + 1]byte
+	plain   [ChunkSize]byte
+	next    byte
+	hasNext bool
 
 	err   error
 	nonce [chacha20poly1305.NonceSize]byte
+	chunk int64 // index of the next chunk to open
 }
 
 const (
@@ -35,7 +104,13 @@ const (
 )
 
 func NewReader(key []byte, src io.Reader) (*Reader, error) {
-	aead, err := chacha20poly1305.New(key)
+	return NewReaderWithCipher(ChaCha20Poly1305, key, src)
+}
+
+// NewReaderWithCipher is like NewReader, but uses c instead of
+// ChaCha20-Poly1305 to open the chunks.
+func NewReaderWithCipher(c Cipher, key []byte, src io.Reader) (*Reader, error) {
+	aead, err := newAEAD(c, key)
 	if err != nil {
 		return nil, err
 	}
@@ -58,14 +133,24 @@ func (r *Reader) Read(p []byte) (int, error) {
 		return 0, nil
 	}
 
-	last, err := r.readChunk()
+	// If p can hold a whole chunk, decrypt directly into it.
+	var dst []byte
+	if len(p) >= ChunkSize {
+		dst = p[:0]
+	}
+	out, last, err := r.readChunk(dst)
 	if err != nil {
 		r.err = err
 		return 0, err
 	}
 
-	n := copy(p, r.unread)
-	r.unread = r.unread[n:]
+	var n int
+	if dst != nil {
+		n = len(out)
+	} else {
+		n = copy(p, out)
+		r.unread = out[n:]
+	}
 
 	if last {
 		r.err = io.EOF
@@ -74,44 +159,123 @@ func (r *Reader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
-// readChunk reads the next chunk of ciphertext from r.c and makes it available
-// in r.unread. last is true if the chunk was marked as the end of the message.
+// WriteTo writes the decrypted chunks to w as they are opened, without
+// copying them to an intermediate buffer.
+func (r *Reader) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if len(r.unread) > 0 {
+			nn, err := w.Write(r.unread)
+			n += int64(nn)
+			r.unread = r.unread[nn:]
+			if err != nil {
+				return n, err
+			}
+		}
+		if r.err == io.EOF {
+			return n, nil
+		}
+		if r.err != nil {
+			return n, r.err
+		}
+
+		out, last, err := r.readChunk(nil)
+		if err != nil {
+			r.err = err
+			return n, err
+		}
+		r.unread = out
+		if last {
+			r.err = io.EOF
+		}
+	}
+}
+
+// readChunk reads the next chunk of ciphertext from r.src and decrypts it,
+// appending the plaintext to dst if not nil, or to r.plain otherwise.
+// last is true if the chunk was marked as the end of the message.
 // readChunk must not be called again after returning a last chunk or an error.
-func (r *Reader) readChunk() (last bool, err error) {
+func (r *Reader) readChunk(dst []byte) (out []byte, last bool, err error) {
 	if len(r.unread) != 0 {
 		panic("stream: internal error: readChunk called with dirty buffer")
 	}
 
-	in := r.buf[:]
-	n, err := io.ReadFull(r.src, in)
+	start := 0
+	if r.hasNext {
+		r.buf[0] = r.next
+		start = 1
+	}
+	n, err := io.ReadFull(r.src, r.buf[start:])
+	n += start
+	in := r.buf[:n]
 	switch {
-	case err == io.EOF:
+	case n == 0:
 		// A message can't end without a marked chunk. This message is truncated.
-		return false, io.ErrUnexpectedEOF
-	case err == io.ErrUnexpectedEOF:
-		// The last chunk can be short.
-		in = in[:n]
+		return nil, false, ErrTruncated
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		// The last chunk can be short, or full-length if nothing follows it.
 		last = true
 		setLastChunkFlag(&r.nonce)
 	case err != nil:
-		return false, err
+		return nil, false, err
+	default:
+		r.next, r.hasNext = in[encChunkSize], true
+		in = in[:encChunkSize]
 	}
 
-	outBuf := make([]byte, 0, ChunkSize)
-	out, err := r.a.Open(outBuf, r.nonce[:], in, nil)
-	if err != nil && !last {
-		// Check if this was a full-length final chunk.
-		last = true
-		setLastChunkFlag(&r.nonce)
-		out, err = r.a.Open(outBuf, r.nonce[:], in, nil)
+	switch {
+	case dst != nil:
+	case len(in) < encChunkSize:
+		dst = in[:0]
+	default:
+		dst = r.plain[:0]
 	}
-	if err != nil {
-		return false, err
+	out, err = openChunk(r.a, dst, r.nonce[:], r.chunk, in)
+	if err == ErrTruncated {
+		// The chunk is valid, but not the last one. Return it, and fail at the
+		// next one, which is missing.
+		last, r.hasNext = false, false
+		r.nonce[len(r.nonce)-1] = 0
+	} else if err != nil {
+		return nil, false, err
 	}
 
 	incNonce(&r.nonce)
-	r.unread = r.buf[:copy(r.buf[:], out)]
-	return last, nil
+	r.chunk++
+	return out, last, nil
+}
+
+// Position returns the index of the next chunk to be opened and its offset
+// from the start of the ciphertext. After Read or WriteTo return an error
+// other than io.EOF, it's the chunk that failed to open, and all the data
+// before it was authenticated.
+func (r *Reader) Position() (chunk, offset int64) {
+	return r.chunk, r.chunk * encChunkSize
+}
+
+// openChunk opens chunk index, sealed with nonce, appending the plaintext to
+// dst, which must not overlap in if in is a full chunk. If the chunk fails to
+// open, but would with
+// the opposite last chunk flag, the STREAM has trailing data, or is truncated
+// after it, in which case the plaintext is returned along with ErrTruncated.
+func openChunk(a cipher.AEAD, dst, nonce []byte, index int64, in []byte) ([]byte, error) {
+	out, err := a.Open(dst, nonce, in, nil)
+	if err == nil {
+		return out, nil
+	}
+	// Only full chunks can be either the last one or not.
+	if len(in) == encChunkSize {
+		last := nonce[len(nonce)-1] == lastChunkFlag
+		nonce[len(nonce)-1] ^= lastChunkFlag
+		out, err := a.Open(dst, nonce, in, nil)
+		nonce[len(nonce)-1] ^= lastChunkFlag
+		if err == nil {
+			if last {
+				return out, ErrTruncated
+			}
+			return nil, ErrTrailingData
+		}
+	}
+	return nil, &ErrChunkAuthentication{Index: index, Offset: index * encChunkSize}
 }
 
 func incNonce(nonce *[chacha20poly1305.NonceSize]byte) {
@@ -140,7 +304,13 @@ type Writer struct {
 }
 
 func NewWriter(key []byte, dst io.WriteCloser) (*Writer, error) {
-	aead, err := chacha20poly1305.New(key)
+	return NewWriterWithCipher(ChaCha20Poly1305, key, dst)
+}
+
+// NewWriterWithCipher is like NewWriter, but uses c instead of
+// ChaCha20-Poly1305 to seal the chunks.
+func NewWriterWithCipher(c Cipher, key []byte, dst io.WriteCloser) (*Writer, error) {
+	aead, err := newAEAD(c, key)
 	if err != nil {
 		return nil, err
 	}
@@ -178,6 +348,46 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	return total, nil
 }
 
+// ReadFrom reads plaintext from src directly into the chunk buffer, until
+// src returns io.EOF. Like Write, it doesn't close the Writer.
+func (w *Writer) ReadFrom(src io.Reader) (n int64, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	for {
+		if len(w.unwritten) == ChunkSize {
+			// Flush a full chunk only if more data follows it, since it
+			// might be the last one. The byte past the chunk is free until
+			// it's sealed.
+			nn, err := io.ReadFull(src, w.buf[ChunkSize:ChunkSize+1])
+			if err == io.EOF {
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+			n += int64(nn)
+			next := w.buf[ChunkSize]
+			if err := w.flushChunk(notLastChunk); err != nil {
+				w.err = err
+				return n, err
+			}
+			w.unwritten = append(w.unwritten, next)
+		}
+
+		nn, err := src.Read(w.buf[len(w.unwritten):ChunkSize])
+		n += int64(nn)
+		w.unwritten = w.unwritten[:len(w.unwritten)+nn]
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
 // Close will flush the last chunk and call the underlying
 // WriteCloser's Close method.
 func (w *Writer) Close() error {
@@ -214,3 +424,392 @@ func (w *Writer) flushChunk(last bool) error {
 	incNonce(&w.nonce)
 	return err
 }
+
+// EncryptReader is the pull-based counterpart of Writer: it reads plaintext
+// from src and returns the sealed chunks on Read.
+type EncryptReader struct {
+	a   cipher.AEAD
+	src io.Reader
+
+	unread []byte // sealed but unread data, backed by buf
+	buf    [encChunkSize]byte
+
+	// next is the plaintext byte read past the end of the previous chunk,
+	// to learn that it wasn't the last one.
+	next    byte
+	hasNext bool
+
+	err   error
+	nonce [chacha20poly1305.NonceSize]byte
+}
+
+func NewEncryptReader(key []byte, src io.Reader) (*EncryptReader, error) {
+	return NewEncryptReaderWithCipher(ChaCha20Poly1305, key, src)
+}
+
+// NewEncryptReaderWithCipher is like NewEncryptReader, but uses c instead of
+// ChaCha20-Poly1305 to seal the chunks.
+func NewEncryptReaderWithCipher(c Cipher, key []byte, src io.Reader) (*EncryptReader, error) {
+	aead, err := newAEAD(c, key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptReader{
+		a:   aead,
+		src: src,
+	}, nil
+}
+
+func (r *EncryptReader) Read(p []byte) (int, error) {
+	if len(r.unread) > 0 {
+		n := copy(p, r.unread)
+		r.unread = r.unread[n:]
+		return n, nil
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	last, err := r.sealChunk()
+	if err != nil {
+		r.err = err
+		return 0, err
+	}
+
+	n := copy(p, r.unread)
+	r.unread = r.unread[n:]
+
+	if last {
+		r.err = io.EOF
+	}
+
+	return n, nil
+}
+
+// sealChunk reads the next chunk of plaintext from r.src, and one more byte
+// to tell if it's the last one, and makes it available sealed in r.unread.
+func (r *EncryptReader) sealChunk() (last bool, err error) {
+	start := 0
+	if r.hasNext {
+		r.buf[0] = r.next
+		start = 1
+	}
+	n, err := io.ReadFull(r.src, r.buf[start:ChunkSize+1])
+	n += start
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+		setLastChunkFlag(&r.nonce)
+	case err != nil:
+		return false, err
+	default:
+		r.next, r.hasNext = r.buf[ChunkSize], true
+		n = ChunkSize
+	}
+
+	r.unread = r.a.Seal(r.buf[:0], r.nonce[:], r.buf[:n], nil)
+	incNonce(&r.nonce)
+	return last, nil
+}
+
+// DecryptWriter is the push-based counterpart of Reader: it opens the chunks
+// written to it, and writes the plaintext to dst. A chunk is written to dst
+// only once it's authenticated, and the last chunk only on Close.
+type DecryptWriter struct {
+	a   cipher.AEAD
+	dst io.Writer
+
+	unopened []byte // backed by buf
+	buf      [encChunkSize]byte
+	plain    [ChunkSize]byte
+
+	err   error
+	nonce [chacha20poly1305.NonceSize]byte
+	chunk int64 // index of the next chunk to open
+}
+
+func NewDecryptWriter(key []byte, dst io.Writer) (*DecryptWriter, error) {
+	return NewDecryptWriterWithCipher(ChaCha20Poly1305, key, dst)
+}
+
+// NewDecryptWriterWithCipher is like NewDecryptWriter, but uses c instead of
+// ChaCha20-Poly1305 to open the chunks.
+func NewDecryptWriterWithCipher(c Cipher, key []byte, dst io.Writer) (*DecryptWriter, error) {
+	aead, err := newAEAD(c, key)
+	if err != nil {
+		return nil, err
+	}
+	w := &DecryptWriter{
+		a:   aead,
+		dst: dst,
+	}
+	w.unopened = w.buf[:0]
+	return w, nil
+}
+
+func (w *DecryptWriter) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	total := len(p)
+	for len(p) > 0 {
+		// A full chunk is opened only once more data follows it, since
+		// otherwise it might be the last one.
+		if len(w.unopened) == encChunkSize {
+			if err := w.openChunk(notLastChunk); err != nil {
+				w.err = err
+				return 0, err
+			}
+		}
+		freeBuf := w.buf[len(w.unopened):]
+		n := copy(freeBuf, p)
+		p = p[n:]
+		w.unopened = w.unopened[:len(w.unopened)+n]
+	}
+	return total, nil
+}
+
+// Close opens and writes the last chunk. It doesn't close dst. If Close
+// returns an error, the plaintext written to dst so far is truncated and
+// must not be trusted to be complete.
+func (w *DecryptWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if len(w.unopened) == 0 {
+		// A message can't end without a marked chunk. This message is truncated.
+		w.err = ErrTruncated
+		return w.err
+	}
+	if err := w.openChunk(lastChunk); err != nil {
+		w.err = err
+		return err
+	}
+	w.err = errors.New("stream.DecryptWriter is already closed")
+	return nil
+}
+
+func (w *DecryptWriter) openChunk(last bool) error {
+	if last {
+		setLastChunkFlag(&w.nonce)
+	}
+	dst := w.plain[:0]
+	if len(w.unopened) < encChunkSize {
+		dst = w.unopened[:0]
+	}
+	out, err := openChunk(w.a, dst, w.nonce[:], w.chunk, w.unopened)
+	if err != nil && err != ErrTruncated {
+		return err
+	}
+	incNonce(&w.nonce)
+	w.chunk++
+	w.unopened = w.buf[:0]
+	// If the STREAM is truncated, the chunk is still valid.
+	if _, err := w.dst.Write(out); err != nil {
+		return err
+	}
+	return err
+}
+
+// EncryptedSize returns the size of the STREAM encryption of n bytes.
+func EncryptedSize(n int64) int64 {
+	chunks := (n + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return n + chunks*poly1305.TagSize
+}
+
+// Seal encrypts plaintext in one shot, producing the same output as a Writer,
+// and appends it to dst, which must not overlap plaintext.
+func Seal(c Cipher, key, dst, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(c, key)
+	if err != nil {
+		return nil, err
+	}
+	if size := int(EncryptedSize(int64(len(plaintext)))); cap(dst)-len(dst) < size {
+		newDst := make([]byte, len(dst), len(dst)+size)
+		copy(newDst, dst)
+		dst = newDst
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	for {
+		chunk := plaintext
+		if len(chunk) > ChunkSize {
+			chunk = chunk[:ChunkSize]
+		}
+		plaintext = plaintext[len(chunk):]
+		if len(plaintext) == 0 {
+			setLastChunkFlag(&nonce)
+			return aead.Seal(dst, nonce[:], chunk, nil), nil
+		}
+		dst = aead.Seal(dst, nonce[:], chunk, nil)
+		incNonce(&nonce)
+	}
+}
+
+// Open decrypts the output of Seal or Writer in one shot. It works in place,
+// overwriting ciphertext, and returns a prefix of it holding the plaintext.
+func Open(c Cipher, key, ciphertext []byte) ([]byte, error) {
+	aead, err := newAEAD(c, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) == 0 {
+		return nil, ErrTruncated
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	out := ciphertext[:0]
+	for in, index := ciphertext, int64(0); ; index++ {
+		chunk := in
+		if len(chunk) > encChunkSize {
+			chunk = chunk[:encChunkSize]
+		}
+		in = in[len(chunk):]
+		if len(in) == 0 {
+			setLastChunkFlag(&nonce)
+		}
+		// Open in place, and then move the plaintext down over the tags of
+		// the previous chunks, as the AEAD doesn't allow inexact overlaps.
+		p, err := aead.Open(chunk[:0], nonce[:], chunk, nil)
+		if err != nil {
+			return nil, &ErrChunkAuthentication{Index: index, Offset: index * encChunkSize}
+		}
+		out = append(out, p...)
+		if len(in) == 0 {
+			return out, nil
+		}
+		incNonce(&nonce)
+	}
+}
+
+// PlaintextSize returns the size of the plaintext of a STREAM of size bytes.
+func PlaintextSize(size int64) (int64, error) {
+	chunks := (size + encChunkSize - 1) / encChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	last := size - (chunks-1)*encChunkSize
+	if last < poly1305.TagSize || (last == poly1305.TagSize && chunks > 1) {
+		return 0, errors.New("stream: invalid ciphertext size")
+	}
+	return size - chunks*poly1305.TagSize, nil
+}
+
+// ReaderAt provides random access to a STREAM, decrypting only the chunks
+// that are read. Reads are authenticated one chunk at a time, so a ReadAt
+// succeeds if the chunks it covers are valid, even if others aren't.
+type ReaderAt struct {
+	a      cipher.AEAD
+	src    io.ReaderAt
+	size   int64 // of the plaintext
+	chunks int64
+
+	// mu protects the cache of the most recently opened chunk.
+	mu     sync.Mutex
+	cached int64
+	plain  []byte // backed by buf
+	buf    [encChunkSize]byte
+}
+
+func NewReaderAt(key []byte, src io.ReaderAt, size int64) (*ReaderAt, error) {
+	return NewReaderAtWithCipher(ChaCha20Poly1305, key, src, size)
+}
+
+// NewReaderAtWithCipher is like NewReaderAt, but uses c instead of
+// ChaCha20-Poly1305 to open the chunks. size is the size of the ciphertext.
+//
+// The last chunk is opened right away, so that a truncated STREAM is
+// detected even if it's never read.
+func NewReaderAtWithCipher(c Cipher, key []byte, src io.ReaderAt, size int64) (*ReaderAt, error) {
+	aead, err := newAEAD(c, key)
+	if err != nil {
+		return nil, err
+	}
+	plainSize, err := PlaintextSize(size)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReaderAt{
+		a:      aead,
+		src:    src,
+		size:   plainSize,
+		chunks: (size + encChunkSize - 1) / encChunkSize,
+		cached: -1,
+	}
+	if r.chunks == 0 {
+		r.chunks = 1
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.openChunk(r.chunks - 1); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Size returns the size of the plaintext.
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+func (r *ReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("stream: negative offset")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		if err := r.openChunk(off / ChunkSize); err != nil {
+			return n, err
+		}
+		nn := copy(p[n:], r.plain[off%ChunkSize:])
+		n += nn
+		off += int64(nn)
+	}
+	return n, nil
+}
+
+// openChunk makes the plaintext of chunk index available in r.plain.
+func (r *ReaderAt) openChunk(index int64) error {
+	if r.cached == index {
+		return nil
+	}
+	r.cached = -1
+
+	in := r.buf[:]
+	n, err := r.src.ReadAt(in, index*encChunkSize)
+	if index == r.chunks-1 && err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	in = in[:n]
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	for i, c := 0, uint64(index); c > 0; i, c = i+1, c>>8 {
+		nonce[len(nonce)-2-i] = byte(c)
+	}
+	if index == r.chunks-1 {
+		setLastChunkFlag(&nonce)
+	}
+	out, err := r.a.Open(in[:0], nonce[:], in, nil)
+	if err != nil {
+		return &ErrChunkAuthentication{Index: index, Offset: index * encChunkSize}
+	}
+	r.plain = out
+	r.cached = index
+	return nil
+}
@@ -8,9 +8,13 @@ package stream_test
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"testing"
 
 	"filippo.io/age/internal/format"
@@ -114,3 +118,463 @@ func testRoundTrip(t *testing.T, stepSize, length int) {
 		n += nn
 	}
 }
+
+func TestAES256GCM(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	src := make([]byte, cs+100)
+	for i := range src {
+		src[i] = byte(i)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := stream.NewWriterWithCipher(stream.AES256GCM, key, format.NopCloser(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the chunks against AES-256-GCM with the STREAM nonces: an 11-byte
+	// big endian counter followed by the last chunk flag.
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 12)
+	expected := aead.Seal(nil, nonce, src[:cs], nil)
+	nonce[10], nonce[11] = 1, 1
+	expected = aead.Seal(expected, nonce, src[cs:], nil)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Error("AES-256-GCM STREAM doesn't match the expected chunks")
+	}
+
+	r, err := stream.NewReaderWithCipher(stream.AES256GCM, key, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, src) {
+		t.Error("wrong data after AES-256-GCM round-trip")
+	}
+}
+
+func TestEncryptReaderDecryptWriter(t *testing.T) {
+	for _, length := range []int{0, 1000, cs, cs + 1, 2 * cs, 2*cs + 100} {
+		t.Run(fmt.Sprintf("len=%d", length), func(t *testing.T) {
+			src := make([]byte, length)
+			if _, err := rand.Read(src); err != nil {
+				t.Fatal(err)
+			}
+			key := make([]byte, chacha20poly1305.KeySize)
+			if _, err := rand.Read(key); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := &bytes.Buffer{}
+			w, err := stream.NewWriter(key, format.NopCloser(expected))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(src); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := stream.NewEncryptReader(key, bytes.NewReader(src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ciphertext, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(ciphertext, expected.Bytes()) {
+				t.Fatal("EncryptReader output doesn't match Writer")
+			}
+
+			out := &bytes.Buffer{}
+			dw, err := stream.NewDecryptWriter(key, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for c := ciphertext; len(c) > 0; {
+				n := 1000
+				if n > len(c) {
+					n = len(c)
+				}
+				if _, err := dw.Write(c[:n]); err != nil {
+					t.Fatal(err)
+				}
+				c = c[n:]
+			}
+			if err := dw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), src) {
+				t.Error("DecryptWriter output doesn't match the plaintext")
+			}
+
+			dw, err = stream.NewDecryptWriter(key, ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dw.Write(ciphertext[:len(ciphertext)-1]); err != nil {
+				t.Fatal(err)
+			}
+			if err := dw.Close(); err == nil {
+				t.Error("DecryptWriter accepted a truncated stream")
+			}
+		})
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	for _, length := range []int{0, 1000, cs, cs + 1, 2 * cs, 2*cs + 100} {
+		t.Run(fmt.Sprintf("len=%d", length), func(t *testing.T) {
+			src := make([]byte, length)
+			if _, err := rand.Read(src); err != nil {
+				t.Fatal(err)
+			}
+			key := make([]byte, chacha20poly1305.KeySize)
+			if _, err := rand.Read(key); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := &bytes.Buffer{}
+			w, err := stream.NewWriter(key, format.NopCloser(expected))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(src); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			ciphertext, err := stream.Seal(stream.ChaCha20Poly1305, key, []byte("prefix"), src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(ciphertext[:6]) != "prefix" || !bytes.Equal(ciphertext[6:], expected.Bytes()) {
+				t.Fatal("Seal output doesn't match Writer")
+			}
+			if int64(len(ciphertext)-6) != stream.EncryptedSize(int64(length)) {
+				t.Errorf("EncryptedSize is %d, expected %d", stream.EncryptedSize(int64(length)), len(ciphertext)-6)
+			}
+
+			out, err := stream.Open(stream.ChaCha20Poly1305, key, ciphertext[6:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, src) {
+				t.Error("Open output doesn't match the plaintext")
+			}
+
+			if _, err := stream.Open(stream.ChaCha20Poly1305, key, expected.Bytes()[:expected.Len()-1]); err == nil {
+				t.Error("Open accepted a truncated stream")
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	seal := func(length int) []byte {
+		c, err := stream.Seal(stream.ChaCha20Poly1305, key, nil, make([]byte, length))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	const encChunkSize = cs + 16
+	damaged := seal(2*cs + 100)
+	damaged[encChunkSize+10] ^= 1
+
+	for _, tc := range []struct {
+		name       string
+		ciphertext []byte
+		err        error
+		plaintext  int  // length of the plaintext returned before the error
+		open       bool // whether Open returns the same error
+	}{
+		{"empty", nil, stream.ErrTruncated, 0, true},
+		{"truncated", seal(3 * cs)[:2*encChunkSize], stream.ErrTruncated, 2 * cs, false},
+		{"damaged", damaged, &stream.ErrChunkAuthentication{Index: 1, Offset: encChunkSize}, cs, true},
+		{"trailing", append(seal(cs), 0), stream.ErrTrailingData, 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			checkErr := func(name string, err error) {
+				t.Helper()
+				if e, ok := tc.err.(*stream.ErrChunkAuthentication); ok {
+					var got *stream.ErrChunkAuthentication
+					if !errors.As(err, &got) || *got != *e {
+						t.Errorf("%s: got error %v, expected %v", name, err, e)
+					}
+				} else if !errors.Is(err, tc.err) {
+					t.Errorf("%s: got error %v, expected %v", name, err, tc.err)
+				}
+			}
+
+			r, err := stream.NewReader(key, bytes.NewReader(tc.ciphertext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := io.Copy(ioutil.Discard, r)
+			checkErr("Reader", err)
+			if n != int64(tc.plaintext) {
+				t.Errorf("Reader: got %d bytes, expected %d", n, tc.plaintext)
+			}
+
+			out := &bytes.Buffer{}
+			w, err := stream.NewDecryptWriter(key, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = w.Write(tc.ciphertext); err == nil {
+				err = w.Close()
+			}
+			checkErr("DecryptWriter", err)
+			if out.Len() != tc.plaintext {
+				t.Errorf("DecryptWriter: got %d bytes, expected %d", out.Len(), tc.plaintext)
+			}
+
+			_, err = stream.Open(stream.ChaCha20Poly1305, key, append([]byte(nil), tc.ciphertext...))
+			if err == nil {
+				t.Error("Open succeeded")
+			} else if tc.open {
+				checkErr("Open", err)
+			}
+		})
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	for _, length := range []int{0, 1000, cs, cs + 1, 2 * cs, 2*cs + 100} {
+		t.Run(fmt.Sprintf("len=%d", length), func(t *testing.T) {
+			src := make([]byte, length)
+			if _, err := rand.Read(src); err != nil {
+				t.Fatal(err)
+			}
+			key := make([]byte, chacha20poly1305.KeySize)
+			if _, err := rand.Read(key); err != nil {
+				t.Fatal(err)
+			}
+
+			expected, err := stream.Seal(stream.ChaCha20Poly1305, key, nil, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := &bytes.Buffer{}
+			w, err := stream.NewWriter(key, format.NopCloser(buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := w.ReadFrom(&shortReader{bytes.NewReader(src)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(length) {
+				t.Errorf("ReadFrom returned %d, expected %d", n, length)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), expected) {
+				t.Fatal("ReadFrom output doesn't match Seal")
+			}
+
+			r, err := stream.NewReader(key, bytes.NewReader(expected))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := &bytes.Buffer{}
+			n, err = r.WriteTo(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(length) || !bytes.Equal(out.Bytes(), src) {
+				t.Error("WriteTo output doesn't match the plaintext")
+			}
+
+			trailing := append(expected[:len(expected):len(expected)], 0)
+			r, err = stream.NewReader(key, bytes.NewReader(trailing))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.WriteTo(ioutil.Discard); err == nil {
+				t.Error("Reader accepted trailing data")
+			}
+		})
+	}
+}
+
+// shortReader returns short reads of an odd size, to exercise ReadFrom.
+type shortReader struct{ r io.Reader }
+
+func (r *shortReader) Read(p []byte) (int, error) {
+	if len(p) > 1234 {
+		p = p[:1234]
+	}
+	return r.r.Read(p)
+}
+
+func TestReaderAllocs(t *testing.T) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	ciphertext, err := stream.Seal(stream.ChaCha20Poly1305, key, nil, make([]byte, 32*cs+100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		r, err := stream.NewReader(key, bytes.NewReader(ciphertext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.WriteTo(ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// Opening a chunk must not allocate.
+	if allocs > 10 {
+		t.Errorf("decrypting 33 chunks took %v allocations", allocs)
+	}
+}
+
+const benchmarkSize = 64 << 20
+
+func benchmarkCiphertext(b *testing.B) (key, ciphertext []byte) {
+	key = make([]byte, chacha20poly1305.KeySize)
+	ciphertext, err := stream.Seal(stream.ChaCha20Poly1305, key, nil, make([]byte, benchmarkSize))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return key, ciphertext
+}
+
+func BenchmarkRead(b *testing.B) {
+	for _, size := range []int{4096, cs} {
+		b.Run(fmt.Sprintf("buf=%d", size), func(b *testing.B) {
+			key, ciphertext := benchmarkCiphertext(b)
+			buf := make([]byte, size)
+			b.SetBytes(benchmarkSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r, err := stream.NewReader(key, bytes.NewReader(ciphertext))
+				if err != nil {
+					b.Fatal(err)
+				}
+				for {
+					_, err := r.Read(buf)
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	key, ciphertext := benchmarkCiphertext(b)
+	b.SetBytes(benchmarkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := stream.NewReader(key, bytes.NewReader(ciphertext))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadFrom(b *testing.B) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	plaintext := make([]byte, benchmarkSize)
+	b.SetBytes(benchmarkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w, err := stream.NewWriter(key, format.NopCloser(ioutil.Discard))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.ReadFrom(bytes.NewReader(plaintext)); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	for _, length := range []int{0, 1000, cs, cs + 1, 2 * cs, 2*cs + 100} {
+		t.Run(fmt.Sprintf("len=%d", length), func(t *testing.T) {
+			src := make([]byte, length)
+			if _, err := rand.Read(src); err != nil {
+				t.Fatal(err)
+			}
+			key := make([]byte, chacha20poly1305.KeySize)
+			if _, err := rand.Read(key); err != nil {
+				t.Fatal(err)
+			}
+			ciphertext, err := stream.Seal(stream.ChaCha20Poly1305, key, nil, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if size, err := stream.PlaintextSize(int64(len(ciphertext))); err != nil || size != int64(length) {
+				t.Errorf("PlaintextSize returned %d, %v", size, err)
+			}
+			r, err := stream.NewReaderAt(key, bytes.NewReader(ciphertext), int64(len(ciphertext)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, off := range []int{0, 1, cs - 1, cs, length - 1, length} {
+				if off < 0 || off > length {
+					continue
+				}
+				buf := make([]byte, 200)
+				n, err := r.ReadAt(buf, int64(off))
+				if n < len(buf) && err != io.EOF || n == len(buf) && err != nil {
+					t.Errorf("ReadAt(%d) returned %d, %v", off, n, err)
+				}
+				if !bytes.Equal(buf[:n], src[off:off+n]) {
+					t.Errorf("ReadAt(%d) returned the wrong data", off)
+				}
+			}
+
+			truncated := ciphertext[:len(ciphertext)-1]
+			if _, err := stream.NewReaderAt(key, bytes.NewReader(truncated), int64(len(truncated))); err == nil {
+				t.Error("NewReaderAt accepted a truncated stream")
+			}
+		})
+	}
+}
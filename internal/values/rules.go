@@ -0,0 +1,51 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package values
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"filippo.io/age/internal/age"
+)
+
+// A Rule selects the recipients of the documents matching Pattern.
+type Rule struct {
+	// Pattern is a path.Match pattern. If it contains a slash, it's matched
+	// against the whole slash-separated path of the document, otherwise
+	// against its last element.
+	Pattern string
+
+	Recipients []age.Recipient
+}
+
+// Match reports whether the rule applies to the document at name.
+func (r *Rule) Match(name string) (bool, error) {
+	if !strings.Contains(r.Pattern, "/") {
+		name = path.Base(name)
+	}
+	ok, err := path.Match(r.Pattern, name)
+	if err != nil {
+		return false, fmt.Errorf("invalid pattern %q: %v", r.Pattern, err)
+	}
+	return ok, nil
+}
+
+// MatchRules returns the recipients of the first rule matching name.
+func MatchRules(rules []Rule, name string) ([]age.Recipient, error) {
+	for _, r := range rules {
+		ok, err := r.Match(name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return r.Recipients, nil
+		}
+	}
+	return nil, fmt.Errorf("no rule matches %q", name)
+}
@@ -0,0 +1,430 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// Package values encrypts the values of JSON and YAML documents with age,
+// leaving their keys and structure readable.
+//
+// Each leaf value is encrypted to a random X25519 data key, which is in turn
+// encrypted to the recipients and stored with a MAC of the whole document
+// under the top-level "age" key. The MAC is keyed with the data key, and
+// covers the keys, the plaintext values and their types, and the structure
+// of the document, so that values can't be removed, added, or moved around.
+package values
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"filippo.io/age/internal/age"
+	"golang.org/x/crypto/hkdf"
+	"gopkg.in/yaml.v3"
+)
+
+// A Format is the syntax of a structured document.
+type Format int
+
+const (
+	JSON Format = iota
+	YAML
+)
+
+// FormatForPath returns the Format of a file based on its extension.
+func FormatForPath(name string) (Format, error) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".json":
+		return JSON, nil
+	case ".yaml", ".yml":
+		return YAML, nil
+	}
+	return 0, fmt.Errorf("unknown document format for %q: expected a .json, .yaml or .yml file", name)
+}
+
+// metadataKey is the top-level key holding the data key and the MAC.
+const metadataKey = "age"
+
+// encryptedPrefix marks the values encrypted without armor.
+const encryptedPrefix = "age:"
+
+const armorPreamble = "-----BEGIN AGE ENCRYPTED FILE-----"
+
+// EncryptOptions are optional settings for Encrypt.
+type EncryptOptions struct {
+	// Armor stores values as ASCII armored files, instead of "age:" followed
+	// by a base64 encoded binary file.
+	Armor bool
+}
+
+// Encrypt encrypts every leaf value of the document to recipients. The
+// document must be a mapping at the top level, and must not already have an
+// "age" key. YAML comments and key order are preserved.
+func Encrypt(doc []byte, f Format, opts *EncryptOptions, recipients ...age.Recipient) ([]byte, error) {
+	if opts == nil {
+		opts = &EncryptOptions{}
+	}
+	root, err := parse(doc)
+	if err != nil {
+		return nil, err
+	}
+	if metadataIndex(root) >= 0 {
+		return nil, fmt.Errorf("document already has an %q key", metadataKey)
+	}
+
+	dataKey, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, err
+	}
+	mac := newMAC(dataKey)
+	if err := writeMAC(mac, root); err != nil {
+		return nil, err
+	}
+
+	encryptedKey, err := encryptValue([]byte(dataKey.String()), opts, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if err := walkLeaves(root, "", func(n *yaml.Node, p string) error {
+		v, err := encryptValue(leafPlaintext(n), opts, dataKey.Recipient())
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %v", p, err)
+		}
+		setEncrypted(n, v, opts)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	metadata := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	addKey(metadata, "data_key", encryptedKey, opts)
+	addKey(metadata, "mac", base64.StdEncoding.EncodeToString(mac.Sum(nil)), &EncryptOptions{})
+	root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: metadataKey}, metadata)
+
+	return marshal(root, f)
+}
+
+// Decrypt decrypts a document produced by Encrypt, checks its MAC, and
+// returns it without the "age" key. opts are used to decrypt the data key,
+// and can be nil.
+func Decrypt(doc []byte, f Format, opts *age.DecryptOptions, identities ...age.Identity) ([]byte, error) {
+	root, err := parse(doc)
+	if err != nil {
+		return nil, err
+	}
+	idx := metadataIndex(root)
+	if idx < 0 {
+		return nil, fmt.Errorf("document is not encrypted: missing %q key", metadataKey)
+	}
+	metadata := root.Content[idx+1]
+	root.Content = append(root.Content[:idx:idx], root.Content[idx+2:]...)
+
+	encryptedKey, expectedMAC, err := parseMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+	dataKeyString, err := decryptValue(encryptedKey, opts, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	dataKey, err := age.ParseX25519Identity(string(dataKeyString))
+	if err != nil {
+		return nil, fmt.Errorf("malformed data key: %v", err)
+	}
+
+	if err := walkLeaves(root, "", func(n *yaml.Node, p string) error {
+		plaintext, err := decryptValue(n.Value, nil, dataKey)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %v", p, err)
+		}
+		return setPlaintext(n, plaintext)
+	}); err != nil {
+		return nil, err
+	}
+
+	mac := newMAC(dataKey)
+	if err := writeMAC(mac, root); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac.Sum(nil), expectedMAC) {
+		return nil, errors.New("bad document MAC")
+	}
+
+	return marshal(root, f)
+}
+
+func parse(doc []byte) (*yaml.Node, error) {
+	var n yaml.Node
+	if err := yaml.Unmarshal(doc, &n); err != nil {
+		return nil, fmt.Errorf("failed to parse document: %v", err)
+	}
+	if n.Kind != yaml.DocumentNode || len(n.Content) != 1 || n.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("document must be a mapping at the top level")
+	}
+	root := n.Content[0]
+	// Carry over comments attached to the document, as we only keep the root.
+	if root.HeadComment == "" {
+		root.HeadComment = n.HeadComment
+	}
+	if root.FootComment == "" {
+		root.FootComment = n.FootComment
+	}
+	return root, nil
+}
+
+func metadataIndex(root *yaml.Node) int {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == metadataKey {
+			return i
+		}
+	}
+	return -1
+}
+
+func parseMetadata(n *yaml.Node) (encryptedKey string, mac []byte, err error) {
+	if n.Kind != yaml.MappingNode {
+		return "", nil, fmt.Errorf("malformed %q key: not a mapping", metadataKey)
+	}
+	var macString string
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		switch n.Content[i].Value {
+		case "data_key":
+			encryptedKey = n.Content[i+1].Value
+		case "mac":
+			macString = n.Content[i+1].Value
+		}
+	}
+	if encryptedKey == "" || macString == "" {
+		return "", nil, fmt.Errorf("malformed %q key: missing data_key or mac", metadataKey)
+	}
+	mac, err = base64.StdEncoding.DecodeString(macString)
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed %q key: invalid mac: %v", metadataKey, err)
+	}
+	return encryptedKey, mac, nil
+}
+
+func addKey(m *yaml.Node, key, value string, opts *EncryptOptions) {
+	v := &yaml.Node{Kind: yaml.ScalarNode}
+	setEncrypted(v, value, opts)
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+}
+
+// walkLeaves calls fn for every scalar value in n, but not for mapping keys.
+// p is the path of n, used in error messages.
+func walkLeaves(n *yaml.Node, p string, fn func(n *yaml.Node, p string) error) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return fn(n, p)
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if err := walkLeaves(n.Content[i+1], p+"."+n.Content[i].Value, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			if err := walkLeaves(c, p+"["+strconv.Itoa(i)+"]", fn); err != nil {
+				return err
+			}
+		}
+	case yaml.AliasNode:
+		return fmt.Errorf("unsupported alias at %s", p)
+	}
+	return nil
+}
+
+// leafPlaintext encodes the tag, style and value of a scalar, so that
+// setPlaintext can restore them exactly.
+func leafPlaintext(n *yaml.Node) []byte {
+	return []byte(fmt.Sprintf("%s %d\n%s", n.ShortTag(), n.Style, n.Value))
+}
+
+func setPlaintext(n *yaml.Node, plaintext []byte) error {
+	nl := bytes.IndexByte(plaintext, '\n')
+	if nl < 0 {
+		return errors.New("malformed plaintext")
+	}
+	fields := strings.Fields(string(plaintext[:nl]))
+	if len(fields) != 2 {
+		return errors.New("malformed plaintext")
+	}
+	style, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return errors.New("malformed plaintext")
+	}
+	n.Tag = fields[0]
+	n.Style = yaml.Style(style)
+	n.Value = string(plaintext[nl+1:])
+	return nil
+}
+
+func setEncrypted(n *yaml.Node, value string, opts *EncryptOptions) {
+	n.Tag = "!!str"
+	n.Value = value
+	n.Style = 0
+	if opts.Armor {
+		n.Style = yaml.LiteralStyle
+	}
+}
+
+func encryptValue(plaintext []byte, opts *EncryptOptions, recipients ...age.Recipient) (string, error) {
+	if !opts.Armor {
+		ciphertext, err := age.Seal(plaintext, recipients...)
+		if err != nil {
+			return "", err
+		}
+		return encryptedPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+	}
+	buf := &bytes.Buffer{}
+	w, err := age.EncryptWithArmor(buf, recipients...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func decryptValue(value string, opts *age.DecryptOptions, identities ...age.Identity) ([]byte, error) {
+	var ciphertext []byte
+	switch {
+	case strings.HasPrefix(value, armorPreamble):
+		ciphertext = []byte(value)
+	case strings.HasPrefix(value, encryptedPrefix):
+		var err error
+		ciphertext, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("malformed encrypted value: %v", err)
+		}
+	default:
+		return nil, errors.New("value is not encrypted")
+	}
+	return age.OpenWithOptions(ciphertext, opts, identities...)
+}
+
+func newMAC(dataKey *age.X25519Identity) hash.Hash {
+	key := make([]byte, 32)
+	h := hkdf.New(sha256.New, []byte(dataKey.String()), nil, []byte("age-encryption.org/values MAC"))
+	if _, err := io.ReadFull(h, key); err != nil {
+		panic("age: internal error: failed to read from HKDF: " + err.Error())
+	}
+	return hmac.New(sha256.New, key)
+}
+
+// writeMAC writes an unambiguous encoding of the plaintext document to mac.
+func writeMAC(mac hash.Hash, n *yaml.Node) error {
+	writeString := func(s string) {
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(len(s)))
+		mac.Write(l[:])
+		mac.Write([]byte(s))
+	}
+	switch n.Kind {
+	case yaml.ScalarNode:
+		writeString("scalar")
+		writeString(n.ShortTag())
+		writeString(n.Value)
+	case yaml.MappingNode, yaml.SequenceNode:
+		if n.Kind == yaml.MappingNode {
+			writeString("mapping")
+		} else {
+			writeString("sequence")
+		}
+		writeString(strconv.Itoa(len(n.Content)))
+		for _, c := range n.Content {
+			if err := writeMAC(mac, c); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("unsupported YAML alias")
+	}
+	return nil
+}
+
+func marshal(root *yaml.Node, f Format) ([]byte, error) {
+	if f == JSON {
+		buf := &bytes.Buffer{}
+		if err := writeJSON(buf, root); err != nil {
+			return nil, err
+		}
+		out := &bytes.Buffer{}
+		if err := json.Indent(out, buf.Bytes(), "", "  "); err != nil {
+			return nil, err
+		}
+		out.WriteByte('\n')
+		return out.Bytes(), nil
+	}
+	buf := &bytes.Buffer{}
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(n.Content[i].Value)
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, c := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, c); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.ScalarNode:
+		switch n.ShortTag() {
+		case "!!null":
+			buf.WriteString("null")
+		case "!!bool", "!!int", "!!float":
+			if !json.Valid([]byte(n.Value)) {
+				return fmt.Errorf("value %q can't be represented in JSON", n.Value)
+			}
+			buf.WriteString(n.Value)
+		default:
+			v, _ := json.Marshal(n.Value)
+			buf.Write(v)
+		}
+	default:
+		return errors.New("unsupported YAML alias")
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package values_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"filippo.io/age/internal/age"
+	"filippo.io/age/internal/values"
+)
+
+const testJSON = `{
+  "name": "db",
+  "port": 5432,
+  "ratio": 0.5,
+  "enabled": true,
+  "nothing": null,
+  "users": [
+    {
+      "name": "admin",
+      "password": "hunter2"
+    }
+  ],
+  "empty": {}
+}
+`
+
+const testYAML = `# Database configuration.
+name: db
+port: 5432 # the default
+quoted: "true"
+multiline: |
+  first line
+  second line
+users:
+  - name: admin
+    password: hunter2
+`
+
+func TestRoundTrip(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		doc  string
+		f    values.Format
+	}{
+		{"json", testJSON, values.JSON},
+		{"yaml", testYAML, values.YAML},
+	} {
+		for _, armor := range []bool{false, true} {
+			t.Run(tc.name, func(t *testing.T) {
+				opts := &values.EncryptOptions{Armor: armor}
+				enc, err := values.Encrypt([]byte(tc.doc), tc.f, opts, i.Recipient())
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, secret := range []string{"hunter2", "5432", "admin"} {
+					if bytes.Contains(enc, []byte(secret)) {
+						t.Errorf("encrypted document contains %q", secret)
+					}
+				}
+				for _, key := range []string{"password", "users", "port"} {
+					if !bytes.Contains(enc, []byte(key)) {
+						t.Errorf("encrypted document doesn't contain key %q", key)
+					}
+				}
+
+				dec, err := values.Decrypt(enc, tc.f, nil, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(dec) != tc.doc {
+					t.Errorf("got:\n%s\nexpected:\n%s", dec, tc.doc)
+				}
+			})
+		}
+	}
+}
+
+func TestMAC(t *testing.T) {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := "a: one\nb: two\nc: [x, y]\n"
+	enc, err := values.Encrypt([]byte(doc), values.YAML, nil, i.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(enc), "\n")
+	valueOf := func(key string) string {
+		for _, l := range lines {
+			if strings.HasPrefix(l, key+": ") {
+				return strings.TrimPrefix(l, key+": ")
+			}
+		}
+		t.Fatalf("key %q not found in:\n%s", key, enc)
+		return ""
+	}
+	a, b := valueOf("a"), valueOf("b")
+
+	for name, tampered := range map[string]string{
+		"swapped values": strings.Replace(strings.Replace(string(enc), a, "X", 1), b, a, 1),
+		"removed key":    strings.Replace(string(enc), "b: "+b+"\n", "", 1),
+		"renamed key":    strings.Replace(string(enc), "a: ", "z: ", 1),
+	} {
+		if name == "swapped values" {
+			tampered = strings.Replace(tampered, "X", b, 1)
+		}
+		if _, err := values.Decrypt([]byte(tampered), values.YAML, nil, i); err == nil {
+			t.Errorf("%s: tampered document decrypted successfully", name)
+		}
+	}
+
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := values.Decrypt(enc, values.YAML, nil, other); err == nil {
+		t.Error("document decrypted with the wrong identity")
+	}
+	if _, err := values.Encrypt(enc, values.YAML, nil, i.Recipient()); err == nil {
+		t.Error("encrypted document encrypted again")
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	r, err := age.NewScryptRecipient("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	enc, err := values.Encrypt([]byte(testYAML), values.YAML, nil, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a Prompter, LazyScryptIdentity can't request the passphrase.
+	if _, err := values.Decrypt(enc, values.YAML, nil, &age.LazyScryptIdentity{}); err == nil {
+		t.Error("document decrypted without a passphrase")
+	}
+
+	opts := &age.DecryptOptions{Prompter: &age.StaticPrompter{Secret: []byte("password")}}
+	dec, err := values.Decrypt(enc, values.YAML, opts, &age.LazyScryptIdentity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec) != testYAML {
+		t.Errorf("got:\n%s\nexpected:\n%s", dec, testYAML)
+	}
+}
+
+func TestMatchRules(t *testing.T) {
+	r1, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prod, other := r1.Recipient(), r2.Recipient()
+	rules := []values.Rule{
+		{Pattern: "prod/*.yaml", Recipients: []age.Recipient{prod}},
+		{Pattern: "*.yaml", Recipients: []age.Recipient{other}},
+	}
+	for name, expected := range map[string]age.Recipient{
+		"prod/db.yaml":    prod,
+		"db.yaml":         other,
+		"staging/db.yaml": other,
+	} {
+		rs, err := values.MatchRules(rules, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(rs) != 1 || rs[0] != expected {
+			t.Errorf("%s: matched the wrong rule", name)
+		}
+	}
+	if _, err := values.MatchRules(rules, "db.json"); err == nil {
+		t.Error("db.json matched a rule")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// C interface to libage, built from filippo.io/age/libage with
+//
+//     go build -buildmode=c-shared -o libage.so ./libage
+//
+// Functions that can fail take a char **err argument. On failure, if err is
+// not NULL, *err is set to an error message that must be released with
+// age_free_string. Every returned string must be released with
+// age_free_string, and every handle with age_free.
+//
+// All functions are safe to call from multiple threads.
+
+#ifndef AGE_H
+#define AGE_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+#define AGE_ABI_VERSION 1
+
+// age_handle is an opaque reference to a set of recipients, a set of
+// identities, or a stream. Zero is never a valid handle.
+typedef uint64_t age_handle;
+
+// age_abi_version returns the AGE_ABI_VERSION the library was built with.
+int age_abi_version(void);
+
+void age_free(age_handle h);
+void age_free_string(char *s);
+
+// age_generate_identity returns a new "AGE-SECRET-KEY-1..." X25519 identity.
+char *age_generate_identity(char **err);
+
+// age_identity_to_recipient returns the "age1..." recipient of an X25519
+// identity.
+char *age_identity_to_recipient(const char *identity, char **err);
+
+// age_parse_recipients and age_parse_identities parse a recipients or
+// identities file, with one entry per line and # comments, and return a
+// handle to the parsed set, or zero on error.
+age_handle age_parse_recipients(const char *text, char **err);
+age_handle age_parse_identities(const char *text, char **err);
+
+// age_encryptor_new returns a stream that encrypts its input to the
+// recipients of h, and produces an armored file if armor is not zero.
+age_handle age_encryptor_new(age_handle recipients, int armor, char **err);
+
+// age_decryptor_new returns a stream that decrypts its input with the
+// identities of h. Armored input is not supported.
+age_handle age_decryptor_new(age_handle identities, char **err);
+
+// age_stream_write passes n bytes of input to the stream. It returns zero on
+// success and -1 on error. After an error, the stream must be discarded.
+int age_stream_write(age_handle s, const void *p, size_t n, char **err);
+
+// age_stream_close signals the end of the input, and flushes the output. It
+// returns zero on success and -1 on error. For a decryptor, an error means
+// the file was truncated or corrupted, and all output must be discarded.
+int age_stream_close(age_handle s, char **err);
+
+// age_stream_read copies up to n bytes of the output produced so far into p,
+// and returns how many were copied, or -1 if s is not a stream.
+int64_t age_stream_read(age_handle s, void *p, size_t n);
+
+// age_stream_pending returns how many bytes of output are ready to be read,
+// or -1 if s is not a stream.
+int64_t age_stream_pending(age_handle s);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif // AGE_H
@@ -0,0 +1,281 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// Command libage is a C shared library exposing age to non-Go programs.
+//
+// Build it with
+//
+//	go build -buildmode=c-shared -o libage.so ./libage
+//
+// and use it through the age.h header in this directory. Objects are referred
+// to by opaque handles, which must be released with age_free. Strings returned
+// by the library, including error messages, must be released with
+// age_free_string.
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"filippo.io/age/internal/age"
+	"filippo.io/age/internal/format"
+)
+
+func main() {}
+
+// handles maps the opaque handles passed to C to the Go values they refer
+// to, which C is not allowed to hold pointers to. Zero is never a valid
+// handle.
+var handles struct {
+	sync.Mutex
+	m    map[uint64]interface{}
+	next uint64
+}
+
+func newHandle(v interface{}) C.uint64_t {
+	handles.Lock()
+	defer handles.Unlock()
+	if handles.m == nil {
+		handles.m = make(map[uint64]interface{})
+	}
+	handles.next++
+	handles.m[handles.next] = v
+	return C.uint64_t(handles.next)
+}
+
+func lookupHandle(h C.uint64_t) interface{} {
+	handles.Lock()
+	defer handles.Unlock()
+	return handles.m[uint64(h)]
+}
+
+// setError stores a copy of err in *errOut, if errOut is not NULL.
+func setError(errOut **C.char, err error) {
+	if errOut != nil {
+		*errOut = C.CString(err.Error())
+	}
+}
+
+var errBadHandle = errors.New("invalid handle")
+
+//export age_free
+func age_free(h C.uint64_t) {
+	handles.Lock()
+	defer handles.Unlock()
+	delete(handles.m, uint64(h))
+}
+
+//export age_free_string
+func age_free_string(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+//export age_generate_identity
+func age_generate_identity(errOut **C.char) *C.char {
+	i, err := age.GenerateX25519Identity()
+	if err != nil {
+		setError(errOut, err)
+		return nil
+	}
+	return C.CString(i.String())
+}
+
+//export age_identity_to_recipient
+func age_identity_to_recipient(identity *C.char, errOut **C.char) *C.char {
+	i, err := age.ParseX25519Identity(C.GoString(identity))
+	if err != nil {
+		setError(errOut, err)
+		return nil
+	}
+	return C.CString(i.Recipient().String())
+}
+
+type recipients []age.Recipient
+type identities []age.Identity
+
+//export age_parse_recipients
+func age_parse_recipients(text *C.char, errOut **C.char) C.uint64_t {
+	r, err := age.ParseRecipients(strings.NewReader(C.GoString(text)))
+	if err != nil {
+		setError(errOut, err)
+		return 0
+	}
+	return newHandle(recipients(r))
+}
+
+//export age_parse_identities
+func age_parse_identities(text *C.char, errOut **C.char) C.uint64_t {
+	i, err := age.ParseIdentities(strings.NewReader(C.GoString(text)))
+	if err != nil {
+		setError(errOut, err)
+		return 0
+	}
+	return newHandle(identities(i))
+}
+
+// A stream is the state behind an encryptor or decryptor handle. C writes
+// the input with age_stream_write, and reads the output that's ready so far
+// with age_stream_read.
+type stream struct {
+	sync.Mutex
+	w      io.WriteCloser
+	armor  io.WriteCloser
+	out    bytes.Buffer
+	err    error
+	closed bool
+}
+
+//export age_encryptor_new
+func age_encryptor_new(h C.uint64_t, armor C.int, errOut **C.char) C.uint64_t {
+	r, ok := lookupHandle(h).(recipients)
+	if !ok {
+		setError(errOut, errBadHandle)
+		return 0
+	}
+	s := &stream{}
+	var dst io.Writer = &s.out
+	if armor != 0 {
+		s.armor = format.ArmoredWriter(&s.out)
+		dst = s.armor
+	}
+	w, err := age.Encrypt(dst, r...)
+	if err != nil {
+		setError(errOut, err)
+		return 0
+	}
+	s.w = w
+	return newHandle(s)
+}
+
+//export age_decryptor_new
+func age_decryptor_new(h C.uint64_t, errOut **C.char) C.uint64_t {
+	i, ok := lookupHandle(h).(identities)
+	if !ok {
+		setError(errOut, errBadHandle)
+		return 0
+	}
+	s := &stream{}
+	w, err := age.DecryptWriter(&s.out, i...)
+	if err != nil {
+		setError(errOut, err)
+		return 0
+	}
+	s.w = w
+	return newHandle(s)
+}
+
+func lookupStream(h C.uint64_t) (*stream, error) {
+	s, ok := lookupHandle(h).(*stream)
+	if !ok {
+		return nil, errBadHandle
+	}
+	return s, nil
+}
+
+//export age_stream_write
+func age_stream_write(h C.uint64_t, p unsafe.Pointer, n C.size_t, errOut **C.char) C.int {
+	s, err := lookupStream(h)
+	if err != nil {
+		setError(errOut, err)
+		return -1
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.err == nil && s.closed {
+		s.err = errors.New("write after age_stream_close")
+	}
+	// C.GoBytes takes a C.int, so copy large inputs in bounded steps.
+	for off := C.size_t(0); s.err == nil && off < n; off += writeStep {
+		step := n - off
+		if step > writeStep {
+			step = writeStep
+		}
+		chunk := C.GoBytes(unsafe.Pointer(uintptr(p)+uintptr(off)), C.int(step))
+		_, s.err = s.w.Write(chunk)
+	}
+	if s.err != nil {
+		setError(errOut, s.err)
+		return -1
+	}
+	return 0
+}
+
+// writeStep is the maximum amount of input copied at once by age_stream_write.
+const writeStep = 1 << 20
+
+//export age_stream_close
+func age_stream_close(h C.uint64_t, errOut **C.char) C.int {
+	s, err := lookupStream(h)
+	if err != nil {
+		setError(errOut, err)
+		return -1
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.err == nil && !s.closed {
+		s.closed = true
+		s.err = s.w.Close()
+		if s.err == nil && s.armor != nil {
+			s.err = s.armor.Close()
+		}
+	}
+	if s.err != nil {
+		setError(errOut, s.err)
+		return -1
+	}
+	return 0
+}
+
+// age_stream_read copies up to n bytes of output into p, and returns how
+// many were copied, or -1 if h is not a stream.
+//
+//export age_stream_read
+func age_stream_read(h C.uint64_t, p unsafe.Pointer, n C.size_t) C.int64_t {
+	s, err := lookupStream(h)
+	if err != nil {
+		return -1
+	}
+	s.Lock()
+	defer s.Unlock()
+	if n > C.size_t(s.out.Len()) {
+		n = C.size_t(s.out.Len())
+	}
+	if n == 0 {
+		return 0
+	}
+	C.memcpy(p, unsafe.Pointer(&s.out.Next(int(n))[0]), n)
+	return C.int64_t(n)
+}
+
+//export age_stream_pending
+func age_stream_pending(h C.uint64_t) C.int64_t {
+	s, err := lookupStream(h)
+	if err != nil {
+		return -1
+	}
+	s.Lock()
+	defer s.Unlock()
+	return C.int64_t(s.out.Len())
+}
+
+// ABIVersion is bumped on any incompatible change to age.h.
+const ABIVersion = 1
+
+//export age_abi_version
+func age_abi_version() C.int {
+	return ABIVersion
+}
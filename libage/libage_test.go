@@ -0,0 +1,48 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCProgram(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the C test program is only supported on Linux")
+	}
+	if testing.Short() {
+		t.Skip("building a shared library is slow")
+	}
+	cc := os.Getenv("CC")
+	if cc == "" {
+		cc = "cc"
+	}
+	if _, err := exec.LookPath(cc); err != nil {
+		t.Skipf("C compiler not found: %v", err)
+	}
+
+	dir := t.TempDir()
+	run := func(name string, arg ...string) {
+		t.Helper()
+		cmd := exec.Command(name, arg...)
+		cmd.Env = append(os.Environ(), "LD_LIBRARY_PATH="+dir)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s failed: %v\n%s", name, err, out)
+		}
+	}
+	goTool := filepath.Join(runtime.GOROOT(), "bin", "go")
+	run(goTool, "build", "-buildmode=c-shared", "-o", filepath.Join(dir, "libage.so"), ".")
+	bin := filepath.Join(dir, "test")
+	run(cc, "-std=c99", "-Wall", "-Werror", "-I.", "-o", bin, filepath.Join("testdata", "test.c"),
+		"-L"+dir, "-lage")
+	run(bin)
+}
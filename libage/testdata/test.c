@@ -0,0 +1,160 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// test.c exercises libage through age.h. It's built and run by
+// TestCProgram, and exits with a non-zero status on failure.
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "age.h"
+
+#define CHECK(cond) do { \
+	if (!(cond)) { \
+		fprintf(stderr, "%s:%d: check failed: %s\n", __FILE__, __LINE__, #cond); \
+		exit(1); \
+	} \
+} while (0)
+
+#define CHECK_OK(cond, err) do { \
+	if (!(cond)) { \
+		fprintf(stderr, "%s:%d: %s: %s\n", __FILE__, __LINE__, #cond, err ? err : "(no error)"); \
+		exit(1); \
+	} \
+} while (0)
+
+// drain appends the pending output of s to *buf.
+static void drain(age_handle s, unsigned char **buf, size_t *len) {
+	int64_t n = age_stream_pending(s);
+	CHECK(n >= 0);
+	*buf = realloc(*buf, *len + n + 1);
+	CHECK(*buf != NULL);
+	CHECK(age_stream_read(s, *buf + *len, n) == n);
+	*len += n;
+}
+
+// run feeds in to the stream s in small pieces, and returns 0 on success.
+static int run(age_handle s, const unsigned char *in, size_t in_len,
+		unsigned char **out, size_t *out_len, char **err) {
+	for (size_t off = 0; off < in_len; off += 1000) {
+		size_t n = in_len - off < 1000 ? in_len - off : 1000;
+		if (age_stream_write(s, in + off, n, err) != 0) return -1;
+		drain(s, out, out_len);
+	}
+	if (age_stream_close(s, err) != 0) return -1;
+	drain(s, out, out_len);
+	return 0;
+}
+
+int main(void) {
+	char *err = NULL;
+
+	CHECK(age_abi_version() == AGE_ABI_VERSION);
+
+	char *identity = age_generate_identity(&err);
+	CHECK_OK(identity != NULL, err);
+	CHECK(strncmp(identity, "AGE-SECRET-KEY-1", 16) == 0);
+	char *recipient = age_identity_to_recipient(identity, &err);
+	CHECK_OK(recipient != NULL, err);
+	CHECK(strncmp(recipient, "age1", 4) == 0);
+
+	age_handle recipients = age_parse_recipients(recipient, &err);
+	CHECK_OK(recipients != 0, err);
+	age_handle identities = age_parse_identities(identity, &err);
+	CHECK_OK(identities != 0, err);
+
+	CHECK(age_parse_recipients("not a recipient", &err) == 0);
+	CHECK(err != NULL);
+	age_free_string(err);
+	err = NULL;
+
+	size_t plain_len = 200 * 1024;
+	unsigned char *plain = malloc(plain_len);
+	CHECK(plain != NULL);
+	for (size_t i = 0; i < plain_len; i++) plain[i] = (unsigned char)(i * 7);
+
+	age_handle enc = age_encryptor_new(recipients, 0, &err);
+	CHECK_OK(enc != 0, err);
+	unsigned char *ciphertext = NULL;
+	size_t ciphertext_len = 0;
+	CHECK_OK(run(enc, plain, plain_len, &ciphertext, &ciphertext_len, &err) == 0, err);
+	age_free(enc);
+	CHECK(ciphertext_len > plain_len);
+
+	age_handle dec = age_decryptor_new(identities, &err);
+	CHECK_OK(dec != 0, err);
+	unsigned char *out = NULL;
+	size_t out_len = 0;
+	CHECK_OK(run(dec, ciphertext, ciphertext_len, &out, &out_len, &err) == 0, err);
+	age_free(dec);
+	CHECK(out_len == plain_len);
+	CHECK(memcmp(out, plain, plain_len) == 0);
+	free(out);
+
+	// A truncated file must fail at close.
+	dec = age_decryptor_new(identities, &err);
+	CHECK_OK(dec != 0, err);
+	out = NULL;
+	out_len = 0;
+	CHECK(run(dec, ciphertext, ciphertext_len - 100, &out, &out_len, &err) != 0);
+	CHECK(err != NULL);
+	age_free_string(err);
+	err = NULL;
+	age_free(dec);
+	free(out);
+
+	// A single write larger than the internal copy step.
+	size_t big_len = 3 * 1024 * 1024 + 5;
+	unsigned char *big = calloc(big_len, 1);
+	CHECK(big != NULL);
+	enc = age_encryptor_new(recipients, 0, &err);
+	CHECK_OK(enc != 0, err);
+	CHECK_OK(age_stream_write(enc, big, big_len, &err) == 0, err);
+	CHECK_OK(age_stream_close(enc, &err) == 0, err);
+	out = NULL;
+	out_len = 0;
+	drain(enc, &out, &out_len);
+	age_free(enc);
+	dec = age_decryptor_new(identities, &err);
+	CHECK_OK(dec != 0, err);
+	CHECK_OK(age_stream_write(dec, out, out_len, &err) == 0, err);
+	CHECK_OK(age_stream_close(dec, &err) == 0, err);
+	free(out);
+	out = NULL;
+	out_len = 0;
+	drain(dec, &out, &out_len);
+	age_free(dec);
+	CHECK(out_len == big_len);
+	CHECK(memcmp(out, big, big_len) == 0);
+	free(out);
+	free(big);
+
+	// Armored encryption.
+	enc = age_encryptor_new(recipients, 1, &err);
+	CHECK_OK(enc != 0, err);
+	out = NULL;
+	out_len = 0;
+	CHECK_OK(run(enc, plain, 100, &out, &out_len, &err) == 0, err);
+	age_free(enc);
+	CHECK(strncmp((char *)out, "-----BEGIN AGE ENCRYPTED FILE-----\n", 35) == 0);
+	free(out);
+
+	// Freed and mismatched handles are rejected.
+	CHECK(age_stream_read(enc, plain, 1) == -1);
+	CHECK(age_encryptor_new(identities, 0, &err) == 0);
+	age_free_string(err);
+
+	age_free(recipients);
+	age_free(identities);
+	age_free_string(identity);
+	age_free_string(recipient);
+	free(ciphertext);
+	free(plain);
+
+	printf("ok\n");
+	return 0;
+}